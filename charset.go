@@ -0,0 +1,160 @@
+package xmlfrob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// a charset is a single byte encoding other than UTF-8 supported for
+// input and output.  Bytes are decoded as the code points with the
+// same value, and max is the highest code point which can be encoded.
+type charset struct {
+	name string
+	max  rune
+}
+
+// lookupCharset returns the charset for the encoding label from an XML
+// declaration, or nil for UTF-8
+func lookupCharset(label string) (*charset, error) {
+	switch strings.ToLower(label) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "us-ascii", "ascii":
+		return &charset{name: label, max: 0x7f}, nil
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "latin-1", "l1":
+		return &charset{name: label, max: 0xff}, nil
+	}
+	return nil, fmt.Errorf(`unsupported encoding "%s", only UTF-8, US-ASCII and ISO-8859-1 are supported; convert the input to UTF-8 first, e.g. with iconv -f %s -t UTF-8, and update the XML declaration`, label, label)
+}
+
+// declaredEncoding returns the encoding given in the XML declaration
+// at the start of r, if any, without consuming any input
+func declaredEncoding(r *bufio.Reader) string {
+	start, _ := r.Peek(512)
+	if !bytes.HasPrefix(start, []byte("<?xml")) {
+		return ""
+	}
+	end := bytes.Index(start, []byte("?>"))
+	if end < 0 {
+		return ""
+	}
+
+	decl := start[:end]
+	i := bytes.Index(decl, []byte("encoding"))
+	if i < 0 {
+		return ""
+	}
+	rest := bytes.TrimLeft(decl[i+len("encoding"):], " \t\r\n")
+	if len(rest) == 0 || rest[0] != '=' {
+		return ""
+	}
+	rest = bytes.TrimLeft(rest[1:], " \t\r\n")
+	if len(rest) == 0 || (rest[0] != '"' && rest[0] != '\'') {
+		return ""
+	}
+	j := bytes.IndexByte(rest[1:], rest[0])
+	if j < 0 {
+		return ""
+	}
+	return string(rest[1 : 1+j])
+}
+
+// decodeInput returns r converted to UTF-8 according to the encoding
+// declared in it, along with the charset to encode the output with, or
+// nil for UTF-8
+func decodeInput(r *bufio.Reader) (*bufio.Reader, *charset, error) {
+	cs, err := lookupCharset(declaredEncoding(r))
+	if err != nil || cs == nil {
+		return r, nil, err
+	}
+	return bufio.NewReader(&charsetReader{r: r, cs: cs}), cs, nil
+}
+
+// newDecoder returns a decoder for input which has already been
+// converted to UTF-8 by decodeInput, so the encoding in the XML
+// declaration must be ignored
+func newDecoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return d
+}
+
+// newInputDecoder returns a decoder for the XML document in, in any
+// encoding supported by lookupCharset
+func newInputDecoder(in io.Reader) (*xml.Decoder, error) {
+	r, _, err := decodeInput(bufio.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	return newDecoder(r), nil
+}
+
+// charsetReader converts single byte charset input to UTF-8.  Bytes
+// above the max of the charset are an error.
+type charsetReader struct {
+	r      io.Reader
+	cs     *charset
+	buf    []byte
+	offset int64 // of buf in the input
+}
+
+func (c *charsetReader) Read(p []byte) (int, error) {
+	// each byte takes up to two bytes in UTF-8
+	if len(p) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	if cap(c.buf) < len(p)/2 {
+		c.buf = make([]byte, len(p)/2)
+	}
+
+	n, err := c.r.Read(c.buf[:len(p)/2])
+	out := p[:0]
+	for i, b := range c.buf[:n] {
+		if rune(b) > c.cs.max {
+			return len(out), fmt.Errorf("invalid byte 0x%02X at offset %d for encoding %s", b, c.offset+int64(i), c.cs.name)
+		}
+		out = utf8.AppendRune(out, rune(b))
+	}
+	c.offset += int64(n)
+	return len(out), err
+}
+
+// charsetWriter converts UTF-8 output to a charset.  Characters the
+// charset cannot represent are written as character references, which
+// is only correct within text and attribute values as they cannot
+// occur in names of a document in that charset.
+type charsetWriter struct {
+	w       io.Writer
+	cs      *charset
+	partial []byte // an incomplete UTF-8 sequence from the last write
+}
+
+func (c *charsetWriter) Write(p []byte) (int, error) {
+	in := append(c.partial, p...)
+	out := make([]byte, 0, len(in))
+	for len(in) > 0 {
+		if !utf8.FullRune(in) {
+			break
+		}
+		r, size := utf8.DecodeRune(in)
+		in = in[size:]
+		if r <= c.cs.max {
+			out = append(out, byte(r))
+		} else {
+			out = fmt.Appendf(out, "&#x%X;", r)
+		}
+	}
+	c.partial = append(c.partial[:0:0], in...)
+
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// hasGlobMeta reports whether the path contains glob metacharacters
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// expandGlob returns the files matching a glob pattern in lexical
+// order.  The syntax is the one of filepath.Match, except that a path
+// segment consisting of ** matches any number of directories, so
+// conf/**/*.xml matches both conf/a.xml and conf/b/c/d.xml.
+func expandGlob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// walk from the longest leading directory without metacharacters
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	n := 0
+	for n < len(segments) && !hasGlobMeta(segments[n]) {
+		n++
+	}
+
+	root := filepath.FromSlash(strings.Join(segments[:n], "/"))
+	if root == "" {
+		root = "."
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		ok, err := matchSegments(segments[n:], strings.Split(filepath.ToSlash(rel), "/"))
+		if ok {
+			matches = append(matches, path)
+		}
+		return err
+	})
+
+	return matches, err
+}
+
+// matchSegments matches path segments against glob pattern segments,
+// where ** matches any number of segments
+func matchSegments(pattern, name []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(name) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(name); skip++ {
+			if ok, err := matchSegments(pattern[1:], name[skip:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	if len(name) == 0 {
+		return false, nil
+	}
+
+	ok, err := filepath.Match(pattern[0], name[0])
+	if !ok || err != nil {
+		return false, err
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// walkDir returns the files below root with one of the extensions, in
+// lexical order.  Files and directories matching one of the exclude
+// patterns are skipped.  A pattern matches if it matches the path
+// relative to root, as with expandGlob, or just the name.  A trailing
+// / in a pattern is ignored, so target/ excludes target directories.
+func walkDir(root string, exts, excludes []string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			excluded, err := matchesAny(excludes, filepath.ToSlash(rel))
+			if err != nil {
+				return err
+			}
+			if excluded && d.IsDir() {
+				return filepath.SkipDir
+			}
+			if excluded {
+				return nil
+			}
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+		for _, ext := range exts {
+			if strings.HasSuffix(path, ext) {
+				files = append(files, path)
+				break
+			}
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// matchesAny reports whether any of the exclude patterns matches the
+// slash separated relative path or its last element, see walkDir
+func matchesAny(patterns []string, rel string) (bool, error) {
+	segments := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		ok, err := matchSegments(strings.Split(pattern, "/"), segments)
+		if err == nil && !ok {
+			ok, err = filepath.Match(pattern, segments[len(segments)-1])
+		}
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isURL reports whether an input is an http or https URL rather than
+// a file name
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://")
+}
+
+// fetch starts downloading url, giving up if the whole download takes
+// longer than timeout.  Responses other than 200 OK are errors.
+func fetch(url string, timeout time.Duration) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		logInformationalError(resp.Body.Close())
+		return nil, fmt.Errorf("could not fetch %s: %s", url, resp.Status)
+	}
+
+	return resp.Body, nil
+}
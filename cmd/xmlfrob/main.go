@@ -0,0 +1,1409 @@
+/*
+xmlfrob implements a program for making minor modifications to XML
+files.
+
+Goals:
+
+ - more robust for XML files than sed
+ - simpler than xsltproc
+ - keep style, indentation and comments of original input file
+
+Example:
+
+  <server>
+      <connector port="8080"/>
+  </server>
+
+  xmlfrob --inplace --input foo.xml /server/connector@port=8181
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chlunde/xmlfrob"
+)
+
+const commandHelp = `Commands:
+  set PATTERNS... FILES...              apply the patterns, the default without a command
+  get PATTERNS... FILES...              print attribute values, like --get
+  del PATTERNS... FILES...              delete attributes or elements, /xml/patt@attr or /xml/patt
+  list FILES...                         print element paths, like --list
+
+`
+
+const patternHelp = `Pattern syntax:
+  /xml/patt@attr=val                    set attribute value, expanding $VAR
+  /xml/patt@attr=@filename              set attribute value from file
+  /xml/patt@attr+=text                  append text to attribute value
+  /xml/patt@attr-=text                  remove text from attribute value
+  /xml/patt@attr~=s/regexp/replacement/ replace regexp matches in value
+  /xml/patt@attr!                       delete attribute
+  /xml/patt@attr~name                   rename attribute
+  /xml/patt~name                        rename element
+  /xml/patt/comment()~=s/regexp/repl/   replace regexp matches in comments
+  /xml/patt!                            delete element
+  /xml/patt+=<fragment/>                insert XML fragment as last child
+  /xml/patt@attr                        print attribute value (with --get)
+  /xml/patt@attr[==old]=val             only modify attr where its value is old
+
+Without patterns, the input is only reformatted, which requires at
+least one of --indent, --minify, --sort-attrs, --empty, --eol, --quote
+or --strip-bom.
+
+`
+
+// the exit statuses besides 0, like those of grep: 0 if anything was
+// changed, or would be with --dry-run, or for --get if any value was
+// found, exitUnchanged if not and exitError on errors
+const (
+	exitUnchanged = 1
+	exitError     = 2
+)
+
+func usage(message string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [COMMAND] [OPTIONS...] [FILES...] [PATTERNS...] [-- FILES...]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s", commandHelp)
+	fmt.Fprintf(os.Stderr, "%s", patternHelp)
+	if message != "" {
+		fmt.Fprintf(os.Stderr, "%v\n", message)
+	} else {
+		flag.PrintDefaults()
+	}
+	os.Exit(exitError)
+}
+
+// formatFlags are the options which change the output of unmodified
+// input, so giving one of them without patterns only reformats it
+var formatFlags = map[string]bool{
+	"indent":     true,
+	"minify":     true,
+	"sort-attrs": true,
+	"empty":      true,
+	"eol":        true,
+	"quote":      true,
+	"strip-bom":  true,
+}
+
+// reformatting reports whether any of formatFlags were given
+func reformatting() bool {
+	var given bool
+	flag.Visit(func(f *flag.Flag) {
+		given = given || formatFlags[f.Name]
+	})
+	return given
+}
+
+// splitArgs separates input files from patterns among the positional
+// arguments.  Patterns start with /, anything else is an input file,
+// as is every argument following --, so absolute paths can be given
+// after --.
+func splitArgs(args []string) (files, patterns []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return append(files, args[i+1:]...), patterns
+		}
+		if strings.HasPrefix(arg, "/") {
+			patterns = append(patterns, arg)
+		} else {
+			files = append(files, arg)
+		}
+	}
+	return files, patterns
+}
+
+// splitCommand returns the command given as the first argument, see
+// commandHelp, and the other arguments.  Without a command, the
+// arguments are returned as is, and patterns are applied as with set.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "set", "get", "del", "list":
+			return args[0], args[1:]
+		}
+	}
+	return "", args
+}
+
+// options controls how processFile handles each input file
+type options struct {
+	inplace bool // write the result back to the input file
+	dryRun  bool // print a diff of the changes instead of the result
+	plan    bool // print the changes, one per line, instead of the result
+	get     bool // print attribute values instead of modifying
+	list    bool // print element paths instead of modifying
+	attrs   bool // with list, also print attribute paths
+	null    bool // end values and paths with NUL instead of newline
+	count   bool // print the number of times each modification applied
+
+	requireMatch bool   // fail if a modification did not apply to any input
+	backup       string // with inplace, keep the original with this suffix
+	gzip         bool   // the input and output are compressed, regardless of name
+
+	timeout time.Duration // for URLs, the time allowed for each download
+
+	report  bool // collect the changes made to each file in result
+	verbose bool // log matches and changes for each element to stderr
+
+	validate bool // check that the output is well-formed before writing it
+
+	checkIdempotent bool // check that modifying the output again changes nothing
+
+	jobs int // with inplace, the number of files processed in parallel
+
+	strict bool   // fail on errors which are otherwise only logged
+	tmpdir string // with inplace or output, the directory for temporary files
+	output string // write the result to this file instead of stdout
+
+	// found are the files found by expanding globs and directories,
+	// which are skipped if they do not look like XML
+	found map[string]bool
+
+	format xmlfrob.Options
+}
+
+// a typedPattern is a modification pattern given with --int, --bool
+// or --float
+type typedPattern struct {
+	pattern   string
+	valueType xmlfrob.ValueType
+}
+
+// result summarizes the outcome of processFile
+type result struct {
+	changed bool                    // whether the input was changed, see changesDocument, or for dry runs differs from the output
+	found   int                     // for --get, the number of values printed
+	counts  []int                   // the number of times each modification applied
+	changes []xmlfrob.AppliedChange // with report, the changes made
+	skipped bool                    // the input did not look like XML and was not processed
+	log     []byte                  // with --jobs, the --verbose output, written when done
+}
+
+func main() {
+	var (
+		opts          options
+		input         string
+		modsFile      string
+		mapFile       string
+		add           bool
+		template      bool
+		collapseSpace bool
+		increment     bool
+		padWidth      int
+		attrBefore    string
+		onMissing     = "skip"
+		typed         []typedPattern
+		create        bool
+		ignoreCase    bool
+		maxMatches    int
+		unique        bool
+		exts          string
+		excludes      []string
+		allowUnset    bool
+		keepNL        bool
+		reportFile    string
+		namespaces    = make(map[string]string)
+		version       bool
+	)
+
+	flag.Usage = func() { usage("") }
+	flag.StringVar(&input, "input", "-", "input XML file or http(s) URL (default to stdin)")
+	flag.StringVar(&exts, "ext", ".xml", "for directory inputs, process files with these comma separated `extensions`")
+	flag.Func("exclude", "for directory inputs, skip files and directories matching `GLOB`, e.g. target/ (may be repeated)", func(pattern string) error {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+		excludes = append(excludes, pattern)
+		return nil
+	})
+	flag.DurationVar(&opts.timeout, "timeout", 30*time.Second, "time allowed for downloading each URL")
+	flag.StringVar(&modsFile, "mods-file", "", "read modification patterns from file, one per line, or from stdin for -")
+	flag.StringVar(&mapFile, "map", "", "replace attribute values found in `FILE`, with one old=new per line, in all elements")
+	flag.BoolVar(&opts.inplace, "inplace", false, "modify in place (save back to same file as input)")
+	flag.StringVar(&opts.output, "output", "", "write the result to `FILE`, replacing it atomically, instead of stdout, or to stdout for -")
+	flag.BoolVar(&opts.strict, "strict", false, "fail on problems which are otherwise only logged, such as failing to keep the mode or owner of a file")
+	flag.StringVar(&opts.tmpdir, "tmpdir", "", "with --inplace, write temporary files to `DIR` instead of the directory of each file; DIR must be on the same filesystem")
+	flag.IntVar(&opts.jobs, "jobs", 1, "with --inplace, process up to `N` files in parallel")
+	flag.Var((*backupFlag)(&opts.backup), "backup", "with --inplace, keep a copy of the original as FILE.bak, or FILE`SUFFIX` with --backup=SUFFIX")
+	flag.BoolVar(&opts.get, "get", false, "print the values of attributes matching /xml/patt@attr patterns; exit status 1 if none match")
+	flag.BoolVar(&opts.list, "list", false, "print the path of each element in the input instead of modifying it")
+	flag.BoolVar(&opts.null, "null", false, "with --get or --list, end each value or path with a NUL byte instead of a newline, for xargs -0")
+	flag.BoolVar(&opts.null, "0", false, "short for --null")
+	flag.BoolVar(&opts.attrs, "list-attrs", false, "like --list, but also print the attributes of each element")
+	flag.BoolVar(&opts.verbose, "verbose", false, "log the modifications matching each element and the changes made to stderr")
+	flag.BoolVar(&opts.verbose, "v", false, "short for --verbose")
+	flag.BoolVar(&quiet, "quiet", false, "do not log problems which are not errors, such as failing to keep the mode of a file, or print warnings and the number of changes of each file")
+	flag.BoolVar(&quiet, "q", false, "short for --quiet")
+	flag.BoolVar(&opts.count, "count", false, "print the number of times each modification applied to stderr")
+	flag.BoolVar(&opts.checkIdempotent, "check-idempotent", false, "fail, without writing anything, if applying the modifications again to the output would change it")
+	flag.BoolVar(&opts.requireMatch, "require-match", false, "fail if any modification did not apply anywhere in the input files")
+	flag.Func("quote", "quote character for attribute values: preserve (default), single or double", func(value string) error {
+		switch value {
+		case "preserve":
+			opts.format.Quote = xmlfrob.QuotePreserve
+		case "single":
+			opts.format.Quote = xmlfrob.QuoteSingle
+		case "double":
+			opts.format.Quote = xmlfrob.QuoteDouble
+		default:
+			return errors.New("expected preserve, single or double")
+		}
+		return nil
+	})
+	flag.BoolVar(&opts.gzip, "gzip", false, "read and write gzip compressed XML, also for stdin and stdout (implied for input files named *.gz)")
+	flag.Func("report", "write a report of the changes made in `FORMAT` (json) to stderr or --report-file", func(format string) error {
+		if format != "json" {
+			return errors.New("only json is supported")
+		}
+		opts.report = true
+		return nil
+	})
+	flag.StringVar(&reportFile, "report-file", "", "write the --report to `FILE` instead of stderr")
+	flag.StringVar(&opts.format.Indent, "indent", "", "reindent the whole document with `string` for each level, instead of keeping the layout")
+	flag.BoolVar(&opts.format.Minify, "minify", false, "remove whitespace between tags, except in elements with text")
+	flag.BoolVar(&opts.format.OnlyMatches, "only-matches", false, "only print the elements matching the modifications, after modifying them, instead of the whole document")
+	flag.BoolVar(&opts.format.SortAttrs, "sort-attrs", false, "sort the attributes of each element by name, namespace declarations first")
+	flag.BoolVar(&opts.format.Annotate, "annotate", false, "write a comment such as <!-- xmlfrob: port 8080->8181 --> before each element whose attributes or name are changed")
+	flag.Func("empty", "how to write elements without content: collapse to <a/> (default), expand to <a></a> or preserve", func(value string) error {
+		switch value {
+		case "collapse":
+			opts.format.Empty = xmlfrob.EmptyCollapse
+		case "expand":
+			opts.format.Empty = xmlfrob.EmptyExpand
+		case "preserve":
+			opts.format.Empty = xmlfrob.EmptyPreserve
+		default:
+			return errors.New("expected collapse, expand or preserve")
+		}
+		return nil
+	})
+	flag.Func("eol", "line endings of the output: preserve (default), lf or crlf", func(value string) error {
+		switch value {
+		case "preserve":
+			opts.format.EOL = xmlfrob.EOLPreserve
+		case "lf":
+			opts.format.EOL = xmlfrob.EOLLF
+		case "crlf":
+			opts.format.EOL = xmlfrob.EOLCRLF
+		default:
+			return errors.New("expected preserve, lf or crlf")
+		}
+		return nil
+	})
+	flag.BoolVar(&opts.format.AllowConflicts, "allow-conflicts", false, "apply modifications which set the same attribute of an element to different values in order, instead of failing")
+	flag.BoolVar(&opts.format.StripBOM, "strip-bom", false, "remove a UTF-8 byte order mark from the start of the input")
+	flag.BoolVar(&opts.validate, "validate", false, "check that the output is well-formed XML before writing it (always done with --inplace)")
+	flag.BoolVar(&opts.plan, "plan", false, "print each change that would be made, one per line, instead of the result")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "print a unified diff of the changes instead of writing them; exit status 1 if there are none")
+	flag.BoolVar(&add, "add", false, "add attributes missing from matching elements")
+	flag.BoolVar(&increment, "increment", false, "make @attr+=N add N to integer values and @attr-=N subtract it, instead of appending and removing text")
+	flag.IntVar(&padWidth, "pad-width", 0, "with --increment, pad the results with zeros to `N` digits (default: keep the zero padding of the old value)")
+	flag.BoolVar(&template, "template", false, "expand {attr} in values to the value of attr on the same element, with {{ and }} for literal braces")
+	flag.BoolVar(&collapseSpace, "collapse-space", false, "with -=, also remove the whitespace around the removed text, keeping a single space between what remains")
+	flag.StringVar(&attrBefore, "attr-before", "", "put attributes added by --add or --create before the attribute `NAME`, when present, or first for *, instead of last")
+	flag.Func("on-missing", "when a matching element lacks the attribute: skip it (default), add the attribute, or fail with error", func(value string) error {
+		switch value {
+		case "skip", "add", "error":
+			onMissing = value
+			return nil
+		}
+		return errors.New("expected skip, add or error")
+	})
+	flag.Func("ns", "bind `PREFIX=URI`, so PREFIX:name in patterns matches elements in the namespace URI whatever prefix the document uses (may be repeated)", func(value string) error {
+		i := strings.IndexByte(value, '=')
+		if i <= 0 || strings.ContainsAny(value[:i], ":{}") {
+			return errors.New("expected PREFIX=URI")
+		}
+		if uri, ok := namespaces[value[:i]]; ok && uri != value[i+1:] {
+			return fmt.Errorf("prefix %s is already bound to %s", value[:i], uri)
+		}
+		namespaces[value[:i]] = value[i+1:]
+		return nil
+	})
+	typedFlag := func(name string, t xmlfrob.ValueType) {
+		flag.Func(name, "like a /xml/path@attr=value `PATTERN`, but fail unless the value is a valid "+t.String()+" (may be repeated)", func(pattern string) error {
+			typed = append(typed, typedPattern{pattern, t})
+			return nil
+		})
+	}
+	typedFlag("int", xmlfrob.TypeInt)
+	typedFlag("bool", xmlfrob.TypeBool)
+	typedFlag("float", xmlfrob.TypeFloat)
+	flag.BoolVar(&create, "create", false, "create missing elements on the path of set and append modifications, and add missing attributes")
+	flag.IntVar(&maxMatches, "max-matches", 0, "only apply each modification to the first `N` elements it changes in each input, 0 for no limit")
+	flag.BoolVar(&unique, "unique", false, "fail without writing anything if a modification matches more than one element in an input")
+	flag.BoolVar(&ignoreCase, "ignore-case", false, "match element names in patterns regardless of case")
+	flag.BoolVar(&keepNL, "keep-newline", false, "keep the trailing newline of values read from files with attr=@filename")
+	flag.BoolVar(&allowUnset, "allow-unset-env", false, "expand unset environment variables in values to the empty string instead of failing")
+	flag.BoolVar(&version, "version", false, "print the version and VCS revision of xmlfrob and exit")
+
+	command, cmdArgs := splitCommand(os.Args[1:])
+	flag.CommandLine.Parse(cmdArgs) // exits on errors
+	if version {
+		printVersion(os.Stdout)
+		os.Exit(0)
+	}
+
+	args := flag.Args()
+	if n := len(cmdArgs) - len(args); n > 0 && cmdArgs[n-1] == "--" {
+		// flag.Parse drops a -- directly following the flags
+		args = append([]string{"--"}, args...)
+	}
+	files, patterns := splitArgs(args)
+	switch command {
+	case "get":
+		opts.get = true
+	case "list":
+		opts.list = true
+	case "del":
+		for i, p := range patterns {
+			if !strings.HasSuffix(p, "!") {
+				patterns[i] = p + "!"
+			}
+		}
+	}
+	if opts.format.Minify && opts.format.Indent != "" {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --indent and --minify\n")
+		os.Exit(exitError)
+	}
+	opts.list = opts.list || opts.attrs
+	if opts.list {
+		if len(patterns) != 0 || modsFile != "" || mapFile != "" || len(typed) != 0 || opts.inplace || opts.dryRun || opts.get {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: --list takes no patterns and cannot be combined with --inplace, --dry-run or --get\n")
+			os.Exit(exitError)
+		}
+	} else if len(patterns) == 0 && modsFile == "" && mapFile == "" && len(typed) == 0 && (!reformatting() || opts.get || opts.format.OnlyMatches) {
+		usage("At least one modification pattern required, or a formatting option to only reformat the input") // exits
+	}
+
+	if input != "-" {
+		files = append([]string{input}, files...)
+	}
+
+	given := make(map[string]bool)
+	for _, file := range files {
+		given[file] = true
+	}
+
+	// patterns matching no files are reported and counted as failures
+	var failed int
+	files, failed = expandGlobs(files)
+	if len(files) == 0 && failed == 0 {
+		files = []string{"-"}
+	}
+
+	var walked bool
+	files, walked, failed = expandDirs(files, strings.Split(exts, ","), excludes, failed)
+	inputs := len(files) + failed
+
+	opts.found = make(map[string]bool)
+	for _, file := range files {
+		if !given[file] {
+			opts.found[file] = true
+		}
+	}
+
+	for _, file := range files {
+		if modsFile == "-" && file == "-" {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: cannot read both --mods-file - and the input from stdin, give an input file\n")
+			os.Exit(exitError)
+		}
+		if opts.inplace && file == "-" {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --inplace and --input - (stdin)\n")
+			os.Exit(exitError)
+		}
+		if opts.inplace && isURL(file) {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --inplace and URL %s\n", file)
+			os.Exit(exitError)
+		}
+	}
+
+	var modifications []xmlfrob.Modification
+	if modsFile == "-" {
+		var err error
+		modifications, err = xmlfrob.ParseModsFile(os.Stdin, "stdin")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+	} else if modsFile != "" {
+		f, err := os.Open(modsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+		modifications, err = xmlfrob.ParseModsFile(f, modsFile)
+		logInformationalError(f.Close())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+	}
+
+	for _, p := range typed {
+		typedModifications, err := xmlfrob.ParseModifications([]string{p.pattern})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+		for i := range typedModifications {
+			typedModifications[i].Type = p.valueType
+		}
+		modifications = append(modifications, typedModifications...)
+	}
+
+	argModifications, err := xmlfrob.ParseModifications(patterns)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+	if command == "del" {
+		for _, m := range argModifications {
+			if !m.IsDeletion() {
+				fmt.Fprintf(os.Stderr, "Invalid mod \"%s\": only /xml/path@attr and /xml/path patterns are allowed with del\n", strings.TrimSuffix(m.Pattern, "!"))
+				os.Exit(exitError)
+			}
+		}
+	}
+	modifications = append(modifications, argModifications...)
+
+	xmlfrob.BindNamespaces(modifications, namespaces)
+
+	if err := xmlfrob.ExpandEnv(modifications, allowUnset); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+
+	if err := xmlfrob.ReadValueFiles(modifications, keepNL); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+
+	if err := xmlfrob.CheckTypes(modifications); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+
+	for i := range modifications {
+		modifications[i].AddMissing = add || onMissing == "add"
+		modifications[i].FailMissing = onMissing == "error"
+		modifications[i].IgnoreCase = ignoreCase
+		modifications[i].Increment = increment
+		modifications[i].PadWidth = padWidth
+		modifications[i].MaxMatches = maxMatches
+		modifications[i].Unique = unique
+		modifications[i].Create = create
+		modifications[i].Template = template
+		modifications[i].CollapseSpace = collapseSpace
+		modifications[i].AttrBefore = attrBefore
+
+		if modifications[i].IsQuery() != opts.get {
+			if opts.get {
+				fmt.Fprintf(os.Stderr, "Invalid mod \"%s\": only /xml/path@attr patterns are allowed with --get\n", modifications[i].Pattern)
+			} else {
+				fmt.Fprintf(os.Stderr, "Invalid mod \"%s\": missing =value, or use --get to print the value\n", modifications[i].Pattern)
+			}
+			os.Exit(exitError)
+		}
+		if create && !modifications[i].IsQuery() && !modifications[i].Creatable() {
+			fmt.Fprintf(os.Stderr, "Invalid mod \"%s\": --create only supports setting or appending to attributes, without a guard, on paths of element names with optional [@attr='value'] predicates\n", modifications[i].Pattern)
+			os.Exit(exitError)
+		}
+	}
+
+	if padWidth < 0 || (padWidth != 0 && !increment) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --pad-width requires --increment and a width of 0 or more\n")
+		os.Exit(exitError)
+	}
+	if err := xmlfrob.CheckIncrements(modifications); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitError)
+	}
+
+	if mapFile != "" {
+		if opts.get {
+			fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --map with --get\n")
+			os.Exit(exitError)
+		}
+		f, err := os.Open(mapFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+		mapping, err := xmlfrob.ParseValueMap(f, mapFile)
+		logInformationalError(f.Close())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitError)
+		}
+		// map the values of the input, before any pattern applies
+		modifications = append([]xmlfrob.Modification{mapping}, modifications...)
+	}
+
+	opts.validate = opts.validate || opts.inplace || (opts.output != "" && opts.output != "-")
+
+	if opts.plan && (opts.inplace || opts.dryRun || opts.get || opts.format.OnlyMatches) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --plan with --inplace, --dry-run, --get or --only-matches\n")
+		os.Exit(exitError)
+	}
+
+	if opts.format.OnlyMatches && (opts.inplace || opts.dryRun || opts.get) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --only-matches with --inplace, --dry-run or --get\n")
+		os.Exit(exitError)
+	}
+
+	if quiet && opts.verbose {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --quiet and --verbose\n")
+		os.Exit(exitError)
+	}
+
+	if opts.null && !opts.get && !opts.list {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --null requires --get or --list\n")
+		os.Exit(exitError)
+	}
+
+	if opts.checkIdempotent && (opts.get || opts.list || opts.format.OnlyMatches) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --check-idempotent with --get, --list or --only-matches\n")
+		os.Exit(exitError)
+	}
+
+	if add && onMissing == "error" {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --add and --on-missing error\n")
+		os.Exit(exitError)
+	}
+
+	if opts.jobs < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --jobs must be at least 1\n")
+		os.Exit(exitError)
+	}
+
+	if opts.backup != "" && !opts.inplace {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --backup requires --inplace\n")
+		os.Exit(exitError)
+	}
+
+	if opts.output == "-" {
+		opts.output = ""
+	}
+	if opts.output != "" && (opts.inplace || opts.dryRun || opts.get || opts.list || opts.plan) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --output with --inplace, --dry-run, --get, --list or --plan\n")
+		os.Exit(exitError)
+	}
+	if opts.output != "" && inputs != 1 {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --output requires a single input, got %d\n", inputs)
+		os.Exit(exitError)
+	}
+
+	if opts.tmpdir != "" && !opts.inplace && opts.output == "" {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --tmpdir requires --inplace or --output\n")
+		os.Exit(exitError)
+	}
+
+	if attrBefore != "" && !add && onMissing != "add" && !create {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: --attr-before requires --add, --on-missing add or --create\n")
+		os.Exit(exitError)
+	}
+
+	if opts.get && (opts.inplace || opts.dryRun) {
+		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --get with --inplace or --dry-run\n")
+		os.Exit(exitError)
+	}
+
+	var changed bool
+	var found int
+	var fileReports []fileReport
+	counts := make([]int, len(modifications))
+	// other modes write to stdout, and must be processed in order
+	jobs := 1
+	if opts.inplace {
+		jobs = opts.jobs
+	}
+	process := func(file string) (result, error) {
+		if jobs == 1 {
+			return processFile(file, modifications, &opts, os.Stderr)
+		}
+		// keep the --verbose output of each file together
+		var log bytes.Buffer
+		res, err := processFile(file, modifications, &opts, &log)
+		res.log = log.Bytes()
+		return res, err
+	}
+	processFiles(files, jobs, process, func(file string, res result, err error) {
+		os.Stderr.Write(res.log)
+		if opts.report {
+			fileReports = append(fileReports, newFileReport(file, res, err))
+		}
+		changed = changed || res.changed
+		found += res.found
+		for i, n := range res.counts {
+			counts[i] += n
+		}
+		if res.skipped {
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "warning: %s does not look like XML, skipped\n", file)
+			}
+		} else if err != nil {
+			failed++
+			if inputs > 1 {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		} else if walked && !opts.get && !opts.list && !opts.dryRun && !quiet {
+			// summarize each file found in directories
+			var n int
+			for _, c := range res.counts {
+				n += c
+			}
+			plural := "s"
+			if n == 1 {
+				plural = ""
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d change%s\n", file, n, plural)
+		}
+	})
+
+	if opts.count {
+		for i, m := range modifications {
+			fmt.Fprintf(os.Stderr, "%d\t%s\n", counts[i], m.Pattern)
+		}
+	}
+
+	if opts.report {
+		if err := writeReport(reportFile, modifications, counts, fileReports); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write report: %v\n", err)
+			failed++
+		}
+	}
+
+	if opts.requireMatch && !opts.get {
+		unmatched := false
+		for i, m := range modifications {
+			if counts[i] == 0 {
+				fmt.Fprintf(os.Stderr, "Mod \"%s\" did not apply to anything\n", m.Pattern)
+				unmatched = true
+			}
+		}
+		if unmatched && failed == 0 {
+			os.Exit(exitError)
+		}
+	}
+
+	var strictFailed bool
+	if n := informationalErrors.Load(); opts.strict && n > 0 {
+		fmt.Fprintf(os.Stderr, "Failing because of --strict: %d problems were logged\n", n)
+		strictFailed = true
+	}
+
+	if failed != 0 || strictFailed {
+		if inputs > 1 && failed != 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d inputs failed\n", failed, inputs)
+		}
+		os.Exit(exitError)
+	}
+
+	switch {
+	case opts.get:
+		if found == 0 {
+			os.Exit(exitUnchanged)
+		}
+	case opts.dryRun || (!opts.list && len(modifications) > 0):
+		if !changed {
+			os.Exit(exitUnchanged)
+		}
+	}
+}
+
+// processFiles calls process for each file, with up to jobs files in
+// progress at a time, and then done with the results in the order of
+// files.  done is always called from the calling goroutine.
+func processFiles(files []string, jobs int, process func(string) (result, error), done func(string, result, error)) {
+	if jobs <= 1 {
+		for _, file := range files {
+			res, err := process(file)
+			done(file, res, err)
+		}
+		return
+	}
+
+	type outcome struct {
+		res      result
+		err      error
+		finished chan struct{}
+	}
+	outcomes := make([]outcome, len(files))
+	for i := range outcomes {
+		outcomes[i].finished = make(chan struct{})
+	}
+
+	next := make(chan int)
+	go func() {
+		for i := range files {
+			next <- i
+		}
+		close(next)
+	}()
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for i := range next {
+				outcomes[i].res, outcomes[i].err = process(files[i])
+				close(outcomes[i].finished)
+			}
+		}()
+	}
+
+	for i, file := range files {
+		<-outcomes[i].finished
+		done(file, outcomes[i].res, outcomes[i].err)
+	}
+}
+
+// backupFlag is the suffix for --backup, which may also be given
+// without a value to use .bak
+type backupFlag string
+
+func (b *backupFlag) String() string { return string(*b) }
+
+func (b *backupFlag) Set(value string) error {
+	switch value {
+	case "true":
+		value = ".bak"
+	case "false":
+		value = ""
+	case "":
+		return errors.New("empty suffix")
+	}
+	*b = backupFlag(value)
+	return nil
+}
+
+func (b *backupFlag) IsBoolFlag() bool { return true }
+
+// expandDirs replaces directories with the files below them with one
+// of the extensions, see walkDir, and reports whether there were any.
+// Directories which cannot be read are reported and added to failed.
+func expandDirs(files, exts, excludes []string, failed int) ([]string, bool, int) {
+	var expanded []string
+	var walked bool
+	for _, file := range files {
+		if st, err := os.Stat(file); file == "-" || isURL(file) || err != nil || !st.IsDir() {
+			expanded = append(expanded, file)
+			continue
+		}
+
+		walked = true
+		matches, err := walkDir(file, exts, excludes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed++
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, walked, failed
+}
+
+// expandGlobs replaces input files containing glob metacharacters with
+// the files they match, and returns the number of glob patterns which
+// did not match any file
+func expandGlobs(files []string) ([]string, int) {
+	var expanded []string
+	var failed int
+	for _, file := range files {
+		if !hasGlobMeta(file) || isURL(file) {
+			expanded = append(expanded, file)
+			continue
+		}
+
+		matches, err := expandGlob(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed++
+		} else if len(matches) == 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s did not match any files\n", file)
+			failed++
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, failed
+}
+
+// looksLikeXML reports whether the start of r could be XML, that is
+// whether it starts with < after an optional byte order mark and
+// whitespace and does not contain NUL bytes like binary files do.
+// Empty input is left for the parser to report.
+func looksLikeXML(r *bufio.Reader) bool {
+	start, _ := r.Peek(512)
+	if bytes.IndexByte(start, 0) != -1 {
+		return false
+	}
+	start = bytes.TrimLeft(bytes.TrimPrefix(start, []byte("\xef\xbb\xbf")), " \t\r\n")
+	return len(start) == 0 || start[0] == '<'
+}
+
+// separator returns the byte ending each value or path printed by
+// --get and --list
+func (o *options) separator() byte {
+	if o.null {
+		return 0
+	}
+	return '\n'
+}
+
+// processFile applies the modifications to a single input file, URL or
+// stdin for -, and writes the result back to the file if inplace is
+// set and to stdout otherwise.  For dry runs, a diff is written to
+// stdout instead, for --get the values of matching attributes and for
+// --list the element paths.  The --verbose output is written to log.
+func processFile(input string, modifications []xmlfrob.Modification, opts *options, log io.Writer) (result, error) {
+	var in io.Reader
+	if input == "-" {
+		in = os.Stdin
+	} else if isURL(input) {
+		body, err := fetch(input, opts.timeout)
+		if err != nil {
+			return result{}, err
+		}
+		in = body
+		defer func() {
+			logInformationalError(body.Close())
+		}()
+	} else {
+		f, err := os.Open(input)
+		if err != nil {
+			return result{}, err
+		}
+		in = f
+		defer func() {
+			logInformationalError(f.Close())
+		}()
+	}
+
+	compressed := opts.gzip || strings.HasSuffix(input, ".gz")
+	if compressed {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return result{}, err
+		}
+		in = zr
+		defer func() {
+			logInformationalError(zr.Close())
+		}()
+	}
+
+	if opts.found[input] {
+		br := bufio.NewReader(in)
+		if !looksLikeXML(br) {
+			return result{skipped: true}, nil
+		}
+		in = br
+	}
+
+	if opts.get {
+		found, err := xmlfrob.QuerySeparated(in, modifications, os.Stdout, opts.separator())
+		return result{found: found}, err
+	}
+
+	if opts.list {
+		return result{}, xmlfrob.ListSeparated(in, os.Stdout, opts.attrs, opts.separator())
+	}
+
+	format := opts.format
+	var changes []xmlfrob.AppliedChange
+	var changed bool
+	format.OnChange = func(c xmlfrob.AppliedChange) {
+		changed = changed || changesDocument(c)
+		if opts.verbose {
+			logChange(log, input, c)
+		}
+		if opts.report || opts.plan {
+			changes = append(changes, c)
+		}
+	}
+	if opts.verbose {
+		format.OnElement = func(path string, patterns []string) {
+			logElement(log, input, path, patterns)
+		}
+	}
+
+	if opts.plan {
+		// print the changes only once the whole input is known to
+		// be valid
+		var output bytes.Buffer
+		w := io.Discard
+		if opts.checkIdempotent {
+			w = &output
+		}
+		counts, err := xmlfrob.FrobnicateStream(in, w, modifications, &format)
+		if err != nil {
+			return result{}, err
+		}
+		if opts.checkIdempotent {
+			if err := checkIdempotent(output.Bytes(), modifications, format); err != nil {
+				return result{}, err
+			}
+		}
+		for _, c := range changes {
+			if _, err := fmt.Fprintf(os.Stdout, "%s\t%s\n", describeChange(input, c), c.Pattern); err != nil {
+				return result{}, fmt.Errorf("could not write: %v", err)
+			}
+		}
+		return result{changed: changed, counts: counts, changes: changes}, nil
+	}
+
+	if opts.dryRun {
+		// keep the original to diff against
+		original, err := io.ReadAll(in)
+		if err != nil {
+			return result{}, err
+		}
+
+		var outbuf bytes.Buffer
+		counts, err := xmlfrob.FrobnicateWithOptions(bytes.NewReader(original), &outbuf, modifications, &format)
+		if err != nil {
+			return result{}, err
+		}
+		if opts.validate {
+			if err := xmlfrob.Validate(bytes.NewReader(outbuf.Bytes())); err != nil {
+				return result{}, fmt.Errorf("output is not well-formed: %v", err)
+			}
+		}
+		if opts.checkIdempotent {
+			if err := checkIdempotent(outbuf.Bytes(), modifications, format); err != nil {
+				return result{}, err
+			}
+		}
+
+		name := input
+		if name == "-" {
+			name = "stdin"
+		}
+		res := result{changed: !bytes.Equal(original, outbuf.Bytes()), counts: counts, changes: changes}
+		return res, unifiedDiff(os.Stdout, "a/"+name, "b/"+name, original, outbuf.Bytes())
+	}
+
+	if opts.inplace {
+		if opts.backup != "" {
+			if err := backupFile(input, input+opts.backup, opts.tmpdir, opts.strict); err != nil {
+				return result{}, fmt.Errorf("could not write backup, not modified: %v", err)
+			}
+		}
+
+		// stream into the temporary file, which is removed rather
+		// than renamed over the input on errors
+		var counts []int
+		var frobErr error
+		err := writeInplace(input, opts.tmpdir, opts.strict, func(w io.Writer) error {
+			var zw *gzip.Writer
+			if compressed {
+				zw = gzip.NewWriter(w)
+				w = zw
+			}
+
+			var output bytes.Buffer
+			if opts.checkIdempotent {
+				w = io.MultiWriter(w, &output)
+			}
+
+			w, validated := validating(w)
+			counts, frobErr = xmlfrob.FrobnicateStream(in, w, modifications, &format)
+			if err := validated(); err != nil && frobErr == nil {
+				frobErr = fmt.Errorf("output is not well-formed, not modified: %v", err)
+			}
+			if frobErr == nil && opts.checkIdempotent {
+				if err := checkIdempotent(output.Bytes(), modifications, format); err != nil {
+					frobErr = fmt.Errorf("%v, not modified", err)
+				}
+			}
+			if frobErr != nil {
+				return frobErr
+			}
+
+			if zw != nil {
+				return zw.Close()
+			}
+			return nil
+		})
+		if frobErr != nil {
+			return result{}, frobErr
+		}
+		if err != nil {
+			return result{counts: counts}, fmt.Errorf("could not write: %v", err)
+		}
+		return result{changed: changed, counts: counts, changes: changes}, nil
+	}
+
+	// buffer the output, so nothing is written for invalid input
+	var outbuf bytes.Buffer
+	counts, err := xmlfrob.FrobnicateWithOptions(in, &outbuf, modifications, &format)
+	if err != nil {
+		return result{}, err
+	}
+	res := result{changed: changed, counts: counts, changes: changes}
+
+	if opts.validate {
+		if err := xmlfrob.Validate(bytes.NewReader(outbuf.Bytes())); err != nil {
+			return result{}, fmt.Errorf("output is not well-formed: %v", err)
+		}
+	}
+	if opts.checkIdempotent {
+		if err := checkIdempotent(outbuf.Bytes(), modifications, format); err != nil {
+			return result{}, err
+		}
+	}
+
+	write := func(w io.Writer) error {
+		if opts.gzip || (opts.output != "" && strings.HasSuffix(opts.output, ".gz")) {
+			zw := gzip.NewWriter(w)
+			if _, err := io.Copy(zw, &outbuf); err != nil {
+				return err
+			}
+			return zw.Close()
+		}
+		_, err := io.Copy(w, &outbuf)
+		return err
+	}
+	if opts.output != "" {
+		// keep the mode and owner of an existing file, like
+		// --inplace
+		modeFrom := opts.output
+		if _, err := os.Stat(modeFrom); os.IsNotExist(err) {
+			modeFrom = ""
+		}
+		err = replaceFile(opts.output, modeFrom, opts.tmpdir, opts.strict, write)
+	} else {
+		err = write(os.Stdout)
+	}
+	if err != nil {
+		return res, fmt.Errorf("could not write: %v", err)
+	}
+
+	return res, nil
+}
+
+// logElement logs the modifications matching an element to w for
+// --verbose.  The path is prefixed with the input file name unless it
+// is stdin.
+func logElement(w io.Writer, input, path string, patterns []string) {
+	if input != "-" {
+		path = input + ":" + path
+	}
+	if len(patterns) == 0 {
+		fmt.Fprintf(w, "%s: no match\n", path)
+		return
+	}
+	for _, p := range patterns {
+		fmt.Fprintf(w, "%s: matched %s\n", path, p)
+	}
+}
+
+// logChange logs a change to w for --verbose, like logElement
+func logChange(w io.Writer, input string, c xmlfrob.AppliedChange) {
+	fmt.Fprintln(w, describeChange(input, c))
+}
+
+// changesDocument reports whether c changes the document, unlike
+// setting an attribute to the value it already has, so a second run of
+// the same modifications exits with exitUnchanged
+func changesDocument(c xmlfrob.AppliedChange) bool {
+	switch c.Op {
+	case "add", "create", "delete", "delete-element", "insert":
+		return true
+	}
+	return c.Old != c.New
+}
+
+// describeChange returns a change as a single line for --verbose and
+// --plan, with the path prefixed with the input file name unless it is
+// stdin
+func describeChange(input string, c xmlfrob.AppliedChange) string {
+	if input != "-" {
+		c.Path = input + ":" + c.Path
+	}
+	switch {
+	case c.Attr != "":
+		return fmt.Sprintf("%s: %s @%s %q -> %q", c.Path, c.Op, c.Attr, c.Old, c.New)
+	case c.Old != "" || c.New != "":
+		return fmt.Sprintf("%s: %s %q -> %q", c.Path, c.Op, c.Old, c.New)
+	default:
+		return fmt.Sprintf("%s: %s", c.Path, c.Op)
+	}
+}
+
+// checkIdempotent returns an error if applying the modifications with
+// format again to output, the result of applying them, would change
+// it, as a second run would then modify the file again.  This is
+// expected for appending and inserting, but otherwise a sign that the
+// output is not written as read.
+func checkIdempotent(output []byte, modifications []xmlfrob.Modification, format xmlfrob.Options) error {
+	// changes of the second run are not reported or logged
+	format.OnChange, format.OnElement = nil, nil
+
+	var again bytes.Buffer
+	if _, err := xmlfrob.FrobnicateWithOptions(bytes.NewReader(output), &again, modifications, &format); err != nil {
+		return fmt.Errorf("not idempotent, the output cannot be modified again: %v", err)
+	}
+	if bytes.Equal(output, again.Bytes()) {
+		return nil
+	}
+
+	line := 1
+	for i := 0; i < len(output) && i < again.Len() && output[i] == again.Bytes()[i]; i++ {
+		if output[i] == '\n' {
+			line++
+		}
+	}
+	return fmt.Errorf("not idempotent, applying the modifications again changes line %d of the output", line)
+}
+
+// validating returns a writer passing the output on to w while
+// checking that it is well-formed XML, and a function to call after
+// writing all of the output to get the result of the check
+func validating(w io.Writer) (io.Writer, func() error) {
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := xmlfrob.Validate(pr)
+		// keep reading, so writes do not block after an error
+		_, _ = io.Copy(io.Discard, pr)
+		result <- err
+	}()
+
+	return io.MultiWriter(w, pw), func() error {
+		logInformationalError(pw.Close())
+		return <-result
+	}
+}
+
+// writeInplace attempts to write replace the original file with new
+// contents atomically, by writing to a temporary file and overwriting
+// the original file using rename.  The contents are written by write,
+// and the original is kept if it fails.
+func writeInplace(filename, tmpdir string, strict bool, write func(io.Writer) error) error {
+	return replaceFile(filename, filename, tmpdir, strict, write)
+}
+
+// backupFile copies filename to backup, replacing any existing backup
+// atomically like writeInplace
+func backupFile(filename, backup, tmpdir string, strict bool) error {
+	original, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		logInformationalError(original.Close())
+	}()
+
+	return replaceFile(backup, filename, tmpdir, strict, func(w io.Writer) error {
+		_, err := io.Copy(w, original)
+		return err
+	})
+}
+
+// replaceFile atomically replaces filename with the contents written
+// by write, giving it the mode and, when running as root, ownership of
+// the file modeFrom, or the default mode of new files if modeFrom is
+// empty.  Failing to do so, or to close the file, is only logged
+// unless strict is set, in which case filename is kept.  The
+// temporary file is created in tmpdir if given, and otherwise next to
+// filename.
+func replaceFile(filename, modeFrom, tmpdir string, strict bool, write func(io.Writer) error) error {
+	output, err := createTemp(filename, tmpdir)
+	if err != nil {
+		return err
+	}
+	tempname := output.Name()
+
+	buffered := bufio.NewWriter(output)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+
+	warn := func(warning error) {
+		if strict && warning != nil && err == nil {
+			err = warning
+			return
+		}
+		logInformationalError(warning)
+	}
+
+	if modeFrom == "" {
+		warn(output.Chmod(newFileMode()))
+	} else if st, statErr := os.Stat(modeFrom); statErr == nil {
+		warn(keepOwnerAndMode(output, modeFrom, st))
+	} else {
+		warn(fmt.Errorf("could not keep the owner and mode of %s: %v", modeFrom, statErr))
+	}
+
+	warn(output.Close())
+
+	if err != nil {
+		logInformationalError(os.Remove(tempname))
+		return fmt.Errorf("error while writing output: %v", err)
+	}
+
+	err = os.Rename(tempname, filename)
+	if err != nil {
+		logInformationalError(os.Remove(tempname))
+		return fmt.Errorf("error while renaming temporary file to destination file: %v", err)
+	}
+
+	// the file has been replaced, so failing to sync is only logged
+	logInformationalError(syncDir(filepath.Dir(filename)))
+	return nil
+}
+
+// syncDir makes a rename in dir durable by syncing the directory
+// itself.  Platforms and filesystems which do not support syncing a
+// directory are not considered an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EBADF) {
+		err = nil
+	}
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not sync directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+// newFileMode returns the mode of files created with os.Create, 0666
+// without the bits in the umask, as temporary files are created with
+// 0600 instead
+func newFileMode() os.FileMode {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return 0666 &^ os.FileMode(umask)
+}
+
+// createTemp creates a temporary file with a random name to be renamed
+// to filename.  As rename only works within a filesystem, tmpdir is
+// only used if it is on the same filesystem as filename, and the
+// directory of filename is used otherwise.
+func createTemp(filename, tmpdir string) (*os.File, error) {
+	dir := filepath.Dir(filename)
+	if tmpdir != "" {
+		same, err := sameFilesystem(tmpdir, dir)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			dir = tmpdir
+		} else {
+			logInformationalError(fmt.Errorf("%s is not on the same filesystem as %s, writing the temporary file to %s instead", tmpdir, filename, dir))
+		}
+	}
+
+	return os.CreateTemp(dir, "."+filepath.Base(filename)+".*.tmp")
+}
+
+// sameFilesystem reports whether the directories a and b are on the
+// same filesystem
+func sameFilesystem(a, b string) (bool, error) {
+	ast, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bst, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	asys, aok := ast.Sys().(*syscall.Stat_t)
+	bsys, bok := bst.Sys().(*syscall.Stat_t)
+	return aok && bok && asys.Dev == bsys.Dev, nil
+}
+
+// keepOwnerAndMode gives f the owner, group and mode of name, as
+// described by orig, including the setuid, setgid and sticky bits.
+// Only the owner and group which differ from those of f are changed.
+// The owner can only be changed by root, so others become the owner
+// of files they edit, like with editors, while they may still keep
+// the group if they are a member of it.  The owner is changed first,
+// as that clears the setuid and setgid bits.  An error is returned if
+// anything else could not be kept.
+func keepOwnerAndMode(f *os.File, name string, orig os.FileInfo) error {
+	var problems []string
+	if ost, ok := orig.Sys().(*syscall.Stat_t); ok {
+		uid, gid := int(ost.Uid), int(ost.Gid)
+		if cur, err := f.Stat(); err == nil {
+			if cst, ok := cur.Sys().(*syscall.Stat_t); ok {
+				if int(cst.Uid) == uid {
+					uid = -1
+				}
+				if int(cst.Gid) == gid {
+					gid = -1
+				}
+			}
+		}
+
+		if uid != -1 || gid != -1 {
+			err := f.Chown(uid, gid)
+			if errors.Is(err, syscall.EPERM) && uid != -1 {
+				// not root, so only the group can be kept
+				err = nil
+				if gid != -1 {
+					err = f.Chown(-1, gid)
+				}
+			}
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if err := f.Chmod(orig.Mode()); err != nil {
+		problems = append(problems, err.Error())
+	} else if cur, err := f.Stat(); err == nil && cur.Mode() != orig.Mode() {
+		// setgid is silently dropped for groups the user is not in
+		problems = append(problems, fmt.Sprintf("mode is %v instead of %v", cur.Mode(), orig.Mode()))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("could not keep the owner and mode of %s: %s", name, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Some errors, like failing to unlink the temporary file when
+// cleaning up after a failure, can't be handled, but we should log
+// them.  This function logs if error is non-nil, and counts the errors
+// logged for --strict.
+func logInformationalError(err error) {
+	if err != nil {
+		informationalErrors.Add(1)
+		if !quiet {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// informationalErrors is the number of errors logged by
+// logInformationalError
+var informationalErrors atomic.Int32
+
+// quiet silences logInformationalError and other messages which are
+// not errors, for --quiet.  The errors are still counted.
+var quiet bool
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when the test binary is run
+// as xmlfrob by run
+func TestMain(m *testing.M) {
+	if os.Getenv("XMLFROB_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs xmlfrob with args in dir, reading stdin, and returns what
+// it wrote to stdout and stderr and its exit status.  cmd, if not nil,
+// gives other attributes of the process, such as the binary to run
+// instead of this test binary.
+func run(t *testing.T, cmd *exec.Cmd, dir, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	if cmd == nil {
+		cmd = &exec.Cmd{}
+	}
+	if cmd.Path == "" {
+		cmd.Path = os.Args[0]
+	}
+	cmd.Args = append([]string{cmd.Path}, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "XMLFROB_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("running %q: %v", args, err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// writeFile writes content to name in dir with mode
+func writeFile(t *testing.T, dir, name, content string, mode os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile returns the content of name in dir
+func readFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInplaceMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0644, 0755, 0640 | os.ModeSetuid, 0750 | os.ModeSetgid, 0666 | os.ModeSticky} {
+		dir := t.TempDir()
+		path := writeFile(t, dir, "a.xml", `<a x="1"/>`, mode)
+
+		_, stderr, code := run(t, nil, dir, "", "--inplace", "--strict", "/a@x=2", "a.xml")
+		if code != 0 {
+			t.Errorf("mode %v: exit status %d: %s", mode, code, stderr)
+		}
+		if got := readFile(t, dir, "a.xml"); got != `<a x="2"/>` {
+			t.Errorf("mode %v: got %q", mode, got)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode() != mode {
+			t.Errorf("mode %v became %v", mode, st.Mode())
+		}
+	}
+}
+
+func TestInplaceInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.xml", `<a y="1" y="2"/>`, 0644)
+
+	_, stderr, code := run(t, nil, dir, "", "--inplace", "/a@x=2", "a.xml")
+	if code != exitError || !strings.Contains(stderr, "attribute y redefined") {
+		t.Errorf("got exit status %d, %s", code, stderr)
+	}
+	if got := readFile(t, dir, "a.xml"); got != `<a y="1" y="2"/>` {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestInplaceOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+
+	dir := t.TempDir()
+	path := writeFile(t, dir, "a.xml", `<a x="1"/>`, 0664)
+	if err := os.Chown(path, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, code := run(t, nil, dir, "", "--inplace", "--strict", "/a@x=2", "a.xml")
+	if code != 0 {
+		t.Fatalf("exit status %d: %s", code, stderr)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys := st.Sys().(*syscall.Stat_t); sys.Uid != 1234 || sys.Gid != 5678 {
+		t.Errorf("owner %d:%d became %d:%d", 1234, 5678, sys.Uid, sys.Gid)
+	}
+}
+
+func TestInplaceOtherOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+
+	// a user in group 5678 edits a group-writable file of another user,
+	// in a directory where both the file and a copy of this test binary
+	// are accessible to them, unlike in t.TempDir
+	dir, err := os.MkdirTemp("", "xmlfrob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	binary, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "xmlfrob", string(binary), 0755)
+	path := writeFile(t, dir, "a.xml", `<a x="1"/>`, 0664)
+	if err := os.Chown(path, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		user := &exec.Cmd{Path: filepath.Join(dir, "xmlfrob"), SysProcAttr: &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: 4321, Gid: 4321, Groups: []uint32{5678}},
+		}}
+		_, stderr, code := run(t, user, dir, "", "--inplace", "--strict", "/a@x+=1", "a.xml")
+		if code != 0 || stderr != "" {
+			t.Fatalf("run %d: exit status %d: %s", i+1, code, stderr)
+		}
+	}
+	if got := readFile(t, dir, "a.xml"); got != `<a x="111"/>` {
+		t.Errorf("got %q", got)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys := st.Sys().(*syscall.Stat_t); sys.Uid != 4321 || sys.Gid != 5678 || st.Mode() != 0664 {
+		t.Errorf("got owner %d:%d and mode %v, want 4321:5678 and %v", sys.Uid, sys.Gid, st.Mode(), os.FileMode(0664))
+	}
+}
+
+func TestCheckIdempotent(t *testing.T) {
+	tests := []struct {
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		{[]string{"/a@x=2"}, 0, "<a x=\"2\">\n  <b/>\n</a>\n", ""},
+		{[]string{"--inplace", "/a@x=2"}, 0, "", ""},
+		{[]string{"/a@x+=2"}, exitError, "", "not idempotent, applying the modifications again changes line 1 of the output\n"},
+		{[]string{"--inplace", "/a@x+=2"}, exitError, "", "not idempotent, applying the modifications again changes line 1 of the output, not modified\n"},
+		{[]string{"/a+=<b/>"}, exitError, "", "not idempotent, applying the modifications again changes line 4 of the output\n"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		input := "<a x=\"1\">\n  <b/>\n</a>\n"
+		writeFile(t, dir, "a.xml", input, 0644)
+
+		args := append([]string{"--check-idempotent"}, test.args...)
+		stdout, stderr, status := run(t, nil, dir, "", append(args, "a.xml")...)
+		if status != test.status || stdout != test.stdout || !strings.HasSuffix(stderr, test.stderr) {
+			t.Errorf("%q: got exit status %d, output %q and errors %q; want %d, %q and %q", args, status, stdout, stderr, test.status, test.stdout, test.stderr)
+		}
+		if got := readFile(t, dir, "a.xml"); status != 0 && got != input {
+			t.Errorf("%q: failed, but changed the file to %q", args, got)
+		}
+	}
+}
+
+// gzipped returns s compressed with gzip
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// gunzipped returns s decompressed with gzip
+func gunzipped(t *testing.T, s string) string {
+	t.Helper()
+	r, err := gzip.NewReader(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("not gzip compressed: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGzip(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.xml.gz", gzipped(t, `<a x="1"/>`), 0644)
+
+	stdout, stderr, status := run(t, nil, dir, "", "/a@x=2", "a.xml.gz")
+	if status != 0 || stdout != `<a x="2"/>` {
+		t.Errorf("stdout: got exit status %d and %q, %s", status, stdout, stderr)
+	}
+
+	stdout, stderr, status = run(t, nil, dir, "", "--gzip", "/a@x=2", "a.xml.gz")
+	if status != 0 || gunzipped(t, stdout) != `<a x="2"/>` {
+		t.Errorf("--gzip: got exit status %d, %s", status, stderr)
+	}
+
+	stdout, stderr, status = run(t, nil, dir, gzipped(t, `<a x="1"/>`), "--gzip", "/a@x=3")
+	if status != 0 || gunzipped(t, stdout) != `<a x="3"/>` {
+		t.Errorf("--gzip on stdin: got exit status %d, %s", status, stderr)
+	}
+
+	_, stderr, status = run(t, nil, dir, "", "--inplace", "/a@x=4", "a.xml.gz")
+	if got := gunzipped(t, readFile(t, dir, "a.xml.gz")); status != 0 || got != `<a x="4"/>` {
+		t.Errorf("--inplace: got exit status %d and %q, %s", status, got, stderr)
+	}
+
+	_, _, status = run(t, nil, dir, `<a x="1"/>`, "--gzip", "/a@x=2")
+	if status != exitError {
+		t.Errorf("--gzip on uncompressed input: got exit status %d, want %d", status, exitError)
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.xml", `<server><connector port="8080"/><connector port="8009"/></server>`, 0644)
+	writeFile(t, dir, "b.xml", `<server/>`, 0644)
+	writeFile(t, dir, "c.xml", `<server>`, 0644)
+
+	_, stderr, status := run(t, nil, dir, "", "--inplace", "--report", "json", "--report-file", "report.json",
+		"/server/connector@port=8181", "/server@x!", "a.xml", "b.xml", "c.xml")
+	if status != exitError {
+		t.Errorf("got exit status %d, want %d for c.xml: %s", status, exitError, stderr)
+	}
+
+	var got report
+	if err := json.Unmarshal([]byte(readFile(t, dir, "report.json")), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := report{
+		Modifications: []modificationReport{
+			{Pattern: "/server/connector@port=8181", Count: 2},
+			{Pattern: "/server@x!", Count: 0},
+		},
+		Files: []fileReport{
+			{File: "a.xml", Changes: []changeReport{
+				{Pattern: "/server/connector@port=8181", Op: "set", Path: "/server[1]/connector[1]", Attribute: "port", Old: "8080", New: "8181"},
+				{Pattern: "/server/connector@port=8181", Op: "set", Path: "/server[1]/connector[2]", Attribute: "port", Old: "8009", New: "8181"},
+			}},
+			{File: "b.xml", Changes: []changeReport{}},
+			{File: "c.xml", Changes: []changeReport{}},
+		},
+	}
+	if len(got.Files) == 3 {
+		if got.Files[2].Error == "" {
+			t.Errorf("no error reported for c.xml")
+		}
+		got.Files[2].Error = ""
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got report %+v, want %+v", got, want)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"/a@x=2"}, 0},
+		{[]string{"/a@x=1"}, exitUnchanged},
+		{[]string{"--add", "/a@x=1", "/a@y=2"}, 0},
+		{[]string{"/b@x=2"}, exitUnchanged},
+		{[]string{"/a@y!"}, exitUnchanged},
+		{[]string{"/a@x!"}, 0},
+		{[]string{"/a@x~x"}, exitUnchanged},
+		{[]string{"/a@x~y"}, 0},
+		{[]string{"/a/b!"}, 0},
+		{[]string{"/a~a"}, exitUnchanged},
+		{[]string{"/a+=<c/>"}, 0},
+		{[]string{"--add", "/a@y="}, 0},
+		{[]string{"--inplace", "/a@x=1"}, exitUnchanged},
+		{[]string{"--inplace", "/a@x=2"}, 0},
+		{[]string{"--dry-run", "/a@x=1"}, exitUnchanged},
+		{[]string{"--dry-run", "/a@x=2"}, 0},
+		{[]string{"--dry-run", "--indent", "  "}, 0},
+		{[]string{"--dry-run", "--eol", "lf"}, exitUnchanged},
+		{[]string{"--plan", "/a@x=1"}, exitUnchanged},
+		{[]string{"--plan", "/a@x=2"}, 0},
+		{[]string{"--indent", "  "}, 0},
+		{[]string{"--get", "/a@x"}, 0},
+		{[]string{"--get", "/a@y"}, exitUnchanged},
+		{[]string{"--require-match", "/b@x=2"}, exitError},
+		{[]string{"/a@x="}, 0},
+		{[]string{"/a@x~=s/(/x/"}, exitError},
+		{[]string{"--increment", "--pad-width", "-1", "/a@x+=1"}, exitError},
+		{[]string{"--increment", "/a@x+=y"}, exitError},
+		{[]string{"--no-such-flag", "/a@x=2"}, exitError},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeFile(t, dir, "a.xml", `<a x="1"><b/></a>`, 0644)
+
+		_, stderr, status := run(t, nil, dir, "", append(test.args, "a.xml")...)
+		if status != test.status {
+			t.Errorf("%q: got exit status %d, want %d: %s", test.args, status, test.status, stderr)
+		}
+	}
+
+	dir := t.TempDir()
+	writeFile(t, dir, "a.xml", `<a x="1"/>`, 0644)
+	writeFile(t, dir, "b.xml", `<a`, 0644)
+	if _, _, status := run(t, nil, dir, "", "/a@x=2", "a.xml", "b.xml"); status != exitError {
+		t.Errorf("with a failed file: got exit status %d, want %d", status, exitError)
+	}
+	for i, want := range []int{0, exitUnchanged} {
+		if _, stderr, status := run(t, nil, dir, "", "--inplace", "/a@x=2", "a.xml"); status != want {
+			t.Errorf("run %d: got exit status %d, want %d: %s", i+1, status, want, stderr)
+		}
+	}
+}
+
+func TestVerboseJobs(t *testing.T) {
+	dir := t.TempDir()
+	var files, want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%02d.xml", i)
+		writeFile(t, dir, name, `<a x="1"><b/><b/><b/></a>`, 0644)
+		files = append(files, name)
+		want = append(want,
+			name+`:/a[1]: matched /a@x=2`,
+			name+`:/a[1]: set @x "1" -> "2"`,
+			name+`:/a[1]/b[1]: matched /a/b@y=3`,
+			name+`:/a[1]/b[2]: matched /a/b@y=3`,
+			name+`:/a[1]/b[3]: matched /a/b@y=3`)
+	}
+
+	args := append([]string{"--inplace", "--jobs", "4", "--verbose", "/a@x=2", "/a/b@y=3"}, files...)
+	_, stderr, status := run(t, nil, dir, "", args...)
+	if status != 0 {
+		t.Fatalf("got exit status %d, %s", status, stderr)
+	}
+	if got := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got --verbose output\n%s\nwant\n%s", stderr, strings.Join(want, "\n"))
+	}
+}
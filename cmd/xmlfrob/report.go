@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/chlunde/xmlfrob"
+)
+
+// report is the JSON document written by --report json
+type report struct {
+	Modifications []modificationReport `json:"modifications"`
+	Files         []fileReport         `json:"files"`
+}
+
+// modificationReport is the number of times a modification applied
+// across all input files
+type modificationReport struct {
+	Pattern string `json:"pattern"`
+	Count   int    `json:"count"`
+}
+
+// fileReport lists the changes made to a single input file
+type fileReport struct {
+	File    string         `json:"file"`
+	Error   string         `json:"error,omitempty"`
+	Changes []changeReport `json:"changes"`
+}
+
+type changeReport struct {
+	Pattern   string `json:"pattern"`
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	Attribute string `json:"attribute,omitempty"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+}
+
+// newFileReport returns the report for a file processed with the given
+// result and error
+func newFileReport(file string, res result, err error) fileReport {
+	r := fileReport{File: file, Changes: []changeReport{}}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	for _, c := range res.changes {
+		r.Changes = append(r.Changes, changeReport{
+			Pattern:   c.Pattern,
+			Op:        c.Op,
+			Path:      c.Path,
+			Attribute: c.Attr,
+			Old:       c.Old,
+			New:       c.New,
+		})
+	}
+	return r
+}
+
+// writeReport writes the JSON report to filename, or stderr if it is
+// empty
+func writeReport(filename string, modifications []xmlfrob.Modification, counts []int, files []fileReport) error {
+	r := report{Files: files}
+	for i, m := range modifications {
+		r.Modifications = append(r.Modifications, modificationReport{Pattern: m.Pattern, Count: counts[i]})
+	}
+
+	var w io.Writer = os.Stderr
+	if filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			logInformationalError(f.Close())
+		}()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(r)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// printVersion writes the module version of the binary, and the VCS
+// revision and time it was built from when available, for --version.
+// Binaries built from a checkout report the version as (devel).
+func printVersion(w io.Writer) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(w, "xmlfrob (unknown version)")
+		return
+	}
+
+	version := info.Main.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	fmt.Fprintf(w, "xmlfrob %s\n", version)
+
+	var revision, committed, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.time":
+			committed = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision != "" {
+		if modified == "true" {
+			revision += " (modified)"
+		}
+		fmt.Fprintf(w, "revision %s", revision)
+		if committed != "" {
+			fmt.Fprintf(w, " from %s", committed)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "built with %s\n", info.GoVersion)
+}
@@ -0,0 +1,191 @@
+package xmlfrob
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+// a creation is a modification with Create whose path matches the
+// element it is recorded for up to some step, along with the number
+// of elements the modification had matched when the element started.
+// If none matched by the end tag, the rest of the path is created.
+type creation struct {
+	m    *Modification
+	base int
+}
+
+// Creatable reports whether Create applies to the modification.  Only
+// set and append modifications without a guard can create elements,
+// and only for paths of element names, optionally with [@attr='value']
+// predicates, which become attributes of the new elements.  Paths with
+// [@attr] or comparison predicates, or templates with Template, cannot
+// be created, as the values are unknown, and neither can paths with
+// text() or child predicates.
+func (m *Modification) Creatable() bool {
+	if (m.op != opSet && m.op != opAppend) || m.guard != nil {
+		return false
+	}
+	if m.Template && strings.ContainsAny(m.value, "{}") {
+		return false
+	}
+	for _, s := range m.path {
+		if s.wildcard || s.comment || s.descendant || s.byNamespace || s.index > 1 {
+			return false
+		}
+		for _, p := range s.predicates {
+			if p.exists || p.text || p.child != "" || p.cmp != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// creating returns the modifications to create below the element
+// at the end of path, which matches the first len(path) steps of each
+// of them
+func creating(creators []*Modification, path []element, matches map[*Modification]int) []creation {
+	var creations []creation
+	for _, m := range creators {
+		if len(path) < len(m.path) && matchSteps(m.path[:len(path)], path, m.IgnoreCase) {
+			creations = append(creations, creation{m: m, base: matches[m]})
+		}
+	}
+	return creations
+}
+
+// a newElements is a chain of missing elements to create, one inside
+// the other, for the modifications sharing the rest of the path, steps
+type newElements struct {
+	steps []step
+	mods  []*Modification
+}
+
+// groupCreations groups the creations of element e which are still
+// missing by their remaining steps, so modifications of several
+// attributes of the same element create it only once
+func groupCreations(e element, depth int, matches map[*Modification]int) []newElements {
+	var groups []newElements
+next:
+	for _, c := range e.creates {
+		if matches[c.m] != c.base {
+			continue
+		}
+		steps := c.m.path[depth:]
+		for i := range groups {
+			if equalSteps(groups[i].steps, steps) {
+				groups[i].mods = append(groups[i].mods, c.m)
+				continue next
+			}
+		}
+		groups = append(groups, newElements{steps: steps, mods: []*Modification{c.m}})
+	}
+	return groups
+}
+
+// equalSteps reports whether two paths of creatable steps are the same
+func equalSteps(a, b []step) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].name != b[i].name || len(a[i].predicates) != len(b[i].predicates) {
+			return false
+		}
+		for j, p := range a[i].predicates {
+			if p != b[i].predicates[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// write writes the new elements, the first one at indent and each
+// nested one by unit more, with the attributes of the predicates and,
+// for the innermost element, of the modifications.  Later values win
+// if an attribute is given more than once.
+func (n newElements) write(w *bytes.Buffer, indent, unit string, quote byte) {
+	last := len(n.steps) - 1
+	for i, s := range n.steps {
+		var attrs []xml.Attr
+		for _, p := range s.predicates {
+			attrs = setNewAttr(attrs, p.attribute, p.value)
+		}
+		if i == last {
+			for _, m := range n.mods {
+				attrs = setNewAttr(attrs, m.attribute, m.value)
+			}
+		}
+
+		if i > 0 {
+			w.WriteString(indent)
+			w.WriteString(strings.Repeat(unit, i))
+		}
+		w.WriteByte('<')
+		w.WriteString(s.name)
+		for _, a := range attrs {
+			w.WriteByte(' ')
+			w.WriteString(qualifiedName(a.Name))
+			w.WriteByte('=')
+			w.WriteByte(quote)
+			escapeAttr(w, a.Value, quote, "", false)
+			w.WriteByte(quote)
+		}
+		if i == last {
+			w.WriteString("/>")
+		} else {
+			w.WriteByte('>')
+		}
+	}
+
+	for i := last - 1; i >= 0; i-- {
+		w.WriteString(indent)
+		w.WriteString(strings.Repeat(unit, i))
+		w.WriteString("</")
+		w.WriteString(n.steps[i].name)
+		w.WriteByte('>')
+	}
+}
+
+// path returns the path of the innermost new element, the parent
+// being at the end of parents and having the children counted so far
+func (n newElements) path(parents []element, children siblings) []element {
+	path := append([]element(nil), parents...)
+	for i, s := range n.steps {
+		name := rename(xml.Name{}, s.name)
+		position := 1
+		if i == 0 {
+			position = children.byName[name.Local] + 1
+		}
+		path = append(path, element{qname: name, position: position})
+	}
+	return path
+}
+
+// setNewAttr sets the attribute name, which may include a prefix, in
+// attrs for a new element
+func setNewAttr(attrs []xml.Attr, name, value string) []xml.Attr {
+	for i := range attrs {
+		if qualifiedName(attrs[i].Name) == name {
+			attrs[i].Value = value
+			return attrs
+		}
+	}
+	return append(attrs, xml.Attr{Name: rename(xml.Name{}, name), Value: value})
+}
+
+// indentUnit guesses the indentation of one level from the
+// indentation of e and of its children, childIndent
+func indentUnit(e element, childIndent string) string {
+	if e.indent != "" && len(childIndent) > len(e.indent) && strings.HasPrefix(childIndent, e.indent) {
+		return childIndent[len(e.indent):]
+	}
+	if e.indent == "" {
+		if unit := strings.TrimLeft(childIndent, "\r\n"); unit != "" {
+			return unit
+		}
+	}
+	return "  "
+}
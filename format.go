@@ -0,0 +1,188 @@
+package xmlfrob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// reindent writes the XML document in data to w with each element,
+// comment and processing instruction on a line of its own, indented
+// by indent for each enclosing element and ended by eol.  Whitespace
+// between tags is replaced, while other text, and tags following it
+// on the same line, are written as they are, so mixed content is
+// mostly kept.  A UTF-8 byte order mark is kept.
+func reindent(data []byte, w io.Writer, indent, eol string) error {
+	br := bufio.NewReader(bytes.NewReader(data))
+	bom, err := skipBOM(br)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if bom {
+		bw.Write(utf8BOM)
+	}
+
+	rec := &recorder{r: br}
+	decoder := newDecoder(rec)
+
+	var depth int
+	var started, lastWasStart, lastWasText bool
+	newline := func() {
+		if started && !lastWasText {
+			bw.WriteString(eol)
+			bw.WriteString(strings.Repeat(indent, depth))
+		}
+	}
+
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		raw := rec.raw(decoder.InputOffset())
+
+		switch tok := tok.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(tok)) == 0 && !bytes.HasPrefix(raw, cdataStart) {
+				continue
+			}
+			bw.Write(raw)
+			lastWasStart, lastWasText = false, true
+			continue
+
+		case xml.StartElement:
+			newline()
+			depth++
+			bw.Write(raw)
+			lastWasStart, lastWasText = true, false
+			started = true
+			continue
+
+		case xml.EndElement:
+			depth--
+			// nothing to write for the end of a self-closing tag
+			if len(raw) != 0 {
+				if !lastWasStart {
+					newline()
+				}
+				bw.Write(raw)
+			}
+
+		case xml.Directive:
+			for name, value := range doctypeEntities(tok) {
+				if decoder.Entity == nil {
+					decoder.Entity = make(map[string]string)
+				}
+				decoder.Entity[name] = value
+			}
+			newline()
+			bw.Write(raw)
+
+		default:
+			newline()
+			bw.Write(raw)
+		}
+		lastWasStart, lastWasText = false, false
+		started = true
+	}
+
+	if started {
+		bw.WriteString(eol)
+	}
+	return bw.Flush()
+}
+
+// minify writes the XML document in data to w without whitespace
+// between tags.  Whitespace is kept in elements which also contain
+// other text, as it is part of the text there, and in elements with
+// xml:space="preserve" and their descendants.  A UTF-8 byte order mark
+// is kept.
+func minify(data []byte, w io.Writer) error {
+	// first find the elements, by number in document order, where
+	// whitespace must be kept
+	keep := make(map[int]bool)
+	var open []int
+	var n int
+	err := walkRaw(data, func(tok xml.Token, raw []byte) {
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			preserve := len(open) > 0 && keep[open[len(open)-1]]
+			for _, a := range tok.Attr {
+				if a.Name.Space == "xml" && a.Name.Local == "space" {
+					preserve = a.Value == "preserve"
+				}
+			}
+			if preserve {
+				keep[n] = true
+			}
+			open = append(open, n)
+			n++
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(open) > 0 && (len(bytes.TrimSpace(tok)) != 0 || bytes.HasPrefix(raw, cdataStart)) {
+				keep[open[len(open)-1]] = true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if bytes.HasPrefix(data, utf8BOM) {
+		bw.Write(utf8BOM)
+	}
+	open, n = open[:0], 0
+	err = walkRaw(data, func(tok xml.Token, raw []byte) {
+		switch tok.(type) {
+		case xml.StartElement:
+			open = append(open, n)
+			n++
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(bytes.TrimSpace(raw)) == 0 && (len(open) == 0 || !keep[open[len(open)-1]]) {
+				return
+			}
+		}
+		bw.Write(raw)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// walkRaw calls fn with each token of the XML document in data along
+// with its raw input.  A UTF-8 byte order mark is skipped.
+func walkRaw(data []byte, fn func(tok xml.Token, raw []byte)) error {
+	rec := &recorder{r: bufio.NewReader(bytes.NewReader(bytes.TrimPrefix(data, utf8BOM)))}
+	decoder := newDecoder(rec)
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if d, ok := tok.(xml.Directive); ok {
+			for name, value := range doctypeEntities(d) {
+				if decoder.Entity == nil {
+					decoder.Entity = make(map[string]string)
+				}
+				decoder.Entity[name] = value
+			}
+		}
+		fn(tok, rec.raw(decoder.InputOffset()))
+	}
+}
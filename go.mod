@@ -0,0 +1,3 @@
+module github.com/chlunde/xmlfrob
+
+go 1.19
@@ -0,0 +1,100 @@
+package xmlfrob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the content of an element as found by lookahead: its text, nil if
+// it has child elements, and the name and content of each child
+// element
+type content struct {
+	name     xml.Name
+	text     *string
+	children []*content
+}
+
+// lookahead reads all of r if any of the modifications has a text() or
+// child predicate, as the content of an element is only known after
+// its start tag is written, and returns the content of each element
+// for tracker.contents along with a reader for the same input.
+// Otherwise r is returned as is, and the input is still streamed.
+func lookahead(r *bufio.Reader, modifications []Modification) (*bufio.Reader, []*content, error) {
+	if !needsContent(modifications) {
+		return r, nil, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := elementContents(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unexpected error while parsing XML file: %v", err)
+	}
+	return bufio.NewReader(bytes.NewReader(data)), contents, nil
+}
+
+// elementContents returns the content of each element of the UTF-8
+// XML document in data, in the order of the start tags.  The text has
+// entity and character references resolved and CDATA sections
+// unwrapped, while comments and processing instructions are ignored.
+func elementContents(data []byte) ([]*content, error) {
+	type open struct {
+		content *content
+		text    strings.Builder
+	}
+
+	var contents []*content
+	var stack []*open
+	decoder := newDecoder(bytes.NewReader(data))
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			return contents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			c := &content{name: tok.Name}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1].content
+				parent.children = append(parent.children, c)
+			}
+			stack = append(stack, &open{content: c})
+			contents = append(contents, c)
+
+		case xml.EndElement:
+			if len(stack) == 0 {
+				// reported by frobnicate
+				return contents, nil
+			}
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(e.content.children) == 0 {
+				text := e.text.String()
+				e.content.text = &text
+			}
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(tok)
+			}
+
+		case xml.Directive:
+			for name, value := range doctypeEntities(tok) {
+				if decoder.Entity == nil {
+					decoder.Entity = make(map[string]string)
+				}
+				decoder.Entity[name] = value
+			}
+		}
+	}
+}
@@ -0,0 +1,1110 @@
+package xmlfrob
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// a step is a single segment of an element path pattern.  A wildcard
+// step matches exactly one element of any name.  A descendant step
+// (preceded by //) may be separated from the previous step, or the
+// root, by any number of elements.  If byNamespace is set, the step
+// only matches elements in the namespace with the URI namespace, and
+// name is compared to the local name only.  A comment step, written as
+// comment(), is the last step of a path and matches comments instead
+// of elements.
+type step struct {
+	name        string
+	namespace   string
+	byNamespace bool
+	wildcard    bool
+	comment     bool
+	descendant  bool
+	predicates  []predicate
+	index       int // 1-based position among siblings, 0 if any
+}
+
+// a predicate restricts a step to elements having an attribute with
+// a specific value, written as [@attr='value'], or, if exists is set,
+// with any value, written as [@attr].  If text is set, it restricts
+// the step to elements containing only the text value instead, written
+// as [text()='value'].  If child is set, it restricts the step to
+// elements with a child element of that name, written as [child], or
+// with one containing only the text value, written as
+// [child='value'].  cmp is the comparison with value, empty for
+// equality, != for inequality, or one of <, <=, > and >= to compare
+// the value as a number with number.  If byNamespace is set, the prefix
+// of attribute was bound to the URI namespace by BindNamespaces.
+type predicate struct {
+	attribute   string
+	namespace   string
+	byNamespace bool
+	child       string
+	value       string
+	exists      bool
+	text        bool
+	cmp         string
+	number      float64
+}
+
+// matches reports whether the step matches an element.  With
+// ignoreCase, the element name and prefix are compared without regard
+// to case, but not the namespace URI.
+func (s step) matches(e element, ignoreCase bool) bool {
+	if s.comment != e.comment {
+		return false
+	}
+	if s.comment {
+		return true
+	}
+
+	if s.byNamespace {
+		if e.namespace != s.namespace || (!s.wildcard && !equalName(e.qname.Local, s.name, ignoreCase)) {
+			return false
+		}
+	} else if !s.wildcard && !matchesElementName(e.qname, s.name, ignoreCase) {
+		return false
+	}
+
+	if s.index != 0 {
+		position := e.position
+		if s.wildcard {
+			position = e.childPosition
+		}
+		if position != s.index {
+			return false
+		}
+	}
+
+	for _, pred := range s.predicates {
+		if !pred.matches(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matches reports whether the element satisfies the predicate.  A
+// missing attribute never matches, and neither does a text predicate
+// for an element with child elements.
+func (p predicate) matches(e element) bool {
+	if p.text {
+		return e.content != nil && e.content.text != nil && p.compare(*e.content.text)
+	}
+	if p.child != "" {
+		if e.content == nil {
+			return false
+		}
+		for _, c := range e.content.children {
+			if matchesName(c.name, p.child) && (p.exists || (c.text != nil && p.compare(*c.text))) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, attr := range e.attr {
+		if matchesAttr(attr.Name, attrNamespace(attr.Name, e.ns), p.attribute, p.namespace, p.byNamespace) {
+			return p.exists || p.compare(attr.Value)
+		}
+	}
+	return false
+}
+
+// compare reports whether value satisfies the comparison of the
+// predicate.  For numeric comparisons, values which are not numbers
+// never match.
+func (p predicate) compare(value string) bool {
+	switch p.cmp {
+	case "":
+		return value == p.value
+	case "!=":
+		return value != p.value
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return false
+	}
+	switch p.cmp {
+	case "<":
+		return n < p.number
+	case "<=":
+		return n <= p.number
+	case ">":
+		return n > p.number
+	default:
+		return n >= p.number
+	}
+}
+
+// needsContent reports whether any of the modifications has a text()
+// or child predicate, which needs the content of elements, see
+// lookahead
+func needsContent(modifications []Modification) bool {
+	for _, m := range modifications {
+		for _, s := range m.path {
+			for _, p := range s.predicates {
+				if p.text || p.child != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// parsePath parses the element path at the start of a pattern into
+// steps, and returns the remainder of the pattern following the path.
+//
+// A segment consisting of only * is a wildcard, while \* matches an
+// element literally named *.  A path of only /, followed by an
+// attribute, is short for /* and matches the root element.  A
+// backslash escapes the next character, so it may also be used for
+// element names containing @ or [.
+//
+// Element names are matched as written in the document.  A name with a
+// prefix, as in soap:Body, only matches elements with that prefix,
+// while a name without one matches regardless of the prefix.  To match
+// by namespace instead, the URI may be given in braces before the
+// name, as in {http://schemas.xmlsoap.org/soap/envelope/}Body, which
+// matches Body elements in that namespace whatever the prefix.  {}Body
+// matches Body elements in no namespace and {uri}* any element in the
+// namespace.
+//
+// // marks the following step as a descendant step, so //a/b matches
+// any b which is a direct child of an a at any depth, and /x//a/b
+// additionally requires x to be the root and an ancestor (not
+// necessarily the parent) of a.
+//
+// Each step may be followed by predicates in brackets, see
+// parsePredicate, which must all hold, and a 1-based index such as
+// [2].  The index counts preceding siblings with the same name, or
+// siblings of any name for *, regardless of any predicate.
+func parsePath(pattern string) ([]step, string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, "", fmt.Errorf("path must start with /")
+	}
+
+	var steps []step
+	pos := 0
+	for pos < len(pattern) && pattern[pos] == '/' {
+		if len(steps) > 0 && steps[len(steps)-1].comment {
+			return nil, "", fmt.Errorf("comment() must be the last step of a path")
+		}
+
+		pos++
+		var s step
+		if pos < len(pattern) && pattern[pos] == '/' {
+			s.descendant = true
+			pos++
+		}
+
+		if pos < len(pattern) && pattern[pos] == '{' {
+			end := strings.IndexByte(pattern[pos:], '}')
+			if end < 0 {
+				return nil, "", fmt.Errorf("missing } after namespace at offset %d", pos)
+			}
+			s.namespace = pattern[pos+1 : pos+end]
+			s.byNamespace = true
+			pos += end + 1
+		}
+
+		var name strings.Builder
+		start := pos
+	name:
+		for ; pos < len(pattern); pos++ {
+			switch pattern[pos] {
+			case '/', '[', '@', '!', '~', '+':
+				break name
+			case '\\':
+				pos++
+				if pos == len(pattern) {
+					return nil, "", fmt.Errorf("unterminated escape at end of pattern")
+				}
+			}
+			name.WriteByte(pattern[pos])
+		}
+
+		rawName := pattern[start:pos]
+		switch {
+		case rawName == "*":
+			s.wildcard = true
+		case rawName == "" && start == 1 && strings.HasPrefix(pattern[pos:], "@"):
+			// /@attr is the root element, whatever its name
+			s.wildcard = true
+		case rawName == "comment()" && !s.byNamespace:
+			s.comment = true
+		case name.Len() == 0:
+			return nil, "", fmt.Errorf("empty element name at offset %d", start)
+		case s.byNamespace && strings.Contains(name.String(), ":"):
+			return nil, "", fmt.Errorf("element %s has both a namespace and a prefix", rawName)
+		default:
+			s.name = name.String()
+		}
+
+		for pos < len(pattern) && pattern[pos] == '[' {
+			if isIndex(pattern[pos:]) {
+				index, n, err := parseIndex(pattern[pos:])
+				if err != nil {
+					return nil, "", err
+				}
+				if s.index != 0 {
+					return nil, "", fmt.Errorf("more than one index for element %s", rawName)
+				}
+				s.index = index
+				pos += n
+				continue
+			}
+
+			pred, n, err := parsePredicate(pattern[pos:])
+			if err != nil {
+				return nil, "", err
+			}
+			s.predicates = append(s.predicates, pred)
+			pos += n
+		}
+
+		if s.comment && (s.index != 0 || len(s.predicates) != 0) {
+			return nil, "", fmt.Errorf("comment() cannot have predicates or an index")
+		}
+
+		steps = append(steps, s)
+	}
+
+	return steps, pattern[pos:], nil
+}
+
+// isIndex reports whether the bracket at the start of s is an index
+// rather than an attribute predicate
+func isIndex(s string) bool {
+	return len(s) > 1 && (s[1] == '-' || (s[1] >= '0' && s[1] <= '9'))
+}
+
+// parseIndex parses an index of the form [2] at the start of s, and
+// returns the number of bytes consumed
+func parseIndex(s string) (int, int, error) {
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return 0, 0, fmt.Errorf("unterminated index %s", s)
+	}
+
+	index, err := strconv.Atoi(s[1:end])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid index %s", s[:end+1])
+	}
+	if index < 1 {
+		return 0, 0, fmt.Errorf("index %s must be 1 or greater", s[:end+1])
+	}
+
+	return index, end + 1, nil
+}
+
+// parsePredicate parses a predicate of the form [@attr='value'],
+// [@attr="value"], [@attr], [text()='value'], [child='value'] or
+// [child] at the start of s, and returns the number of bytes
+// consumed.  Instead of =, the predicate may compare with != as a
+// string, or with <, <=, > or >= as a number, in which case the
+// number need not be quoted, as in [@port>8000].
+func parsePredicate(s string) (predicate, int, error) {
+	// only include the predicate itself in error messages
+	shown := s
+	if i := strings.IndexByte(s, ']'); i >= 0 {
+		shown = s[:i+1]
+	}
+
+	var pred predicate
+	var pos int
+	if strings.HasPrefix(s, "[text()") {
+		pred.text = true
+		pos = len("[text()")
+	} else {
+		end := strings.IndexAny(s, "=!<>]")
+		if end < 0 {
+			return predicate{}, 0, fmt.Errorf("unterminated predicate %s", shown)
+		}
+		if !strings.HasPrefix(s, "[@") {
+			if !validAttrName(s[1:end]) || strings.ContainsAny(s[1:end], "'\"()") {
+				return predicate{}, 0, fmt.Errorf("expected predicate of the form [@attr='value'], [@attr], [text()='value'], [child='value'] or [child], got %s", shown)
+			}
+			if s[end] == ']' {
+				return predicate{child: s[1:end], exists: true}, end + 1, nil
+			}
+			pred.child = s[1:end]
+		} else {
+			if end == 2 {
+				return predicate{}, 0, fmt.Errorf("expected predicate of the form [@attr='value'], [@attr], [text()='value'], [child='value'] or [child], got %s", shown)
+			}
+			if s[end] == ']' {
+				if !validAttrName(s[2:end]) {
+					return predicate{}, 0, fmt.Errorf("invalid attribute name in predicate %s", shown)
+				}
+				return predicate{attribute: s[2:end], exists: true}, end + 1, nil
+			}
+			pred.attribute = s[2:end]
+		}
+		pos = end
+	}
+
+	for _, cmp := range []string{"!=", "<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(s[pos:], cmp) {
+			if cmp != "=" {
+				pred.cmp = cmp
+			}
+			pos += len(cmp)
+			break
+		}
+	}
+	if pos == len(s) || (pred.cmp == "" && s[pos-1] != '=') {
+		return predicate{}, 0, fmt.Errorf("expected =, !=, <, <=, > or >= in predicate %s", shown)
+	}
+
+	numeric := pred.cmp != "" && pred.cmp != "!="
+	if numeric && s[pos] != '\'' && s[pos] != '"' {
+		end := strings.IndexByte(s[pos:], ']')
+		if end < 0 {
+			return predicate{}, 0, fmt.Errorf("unterminated predicate %s", shown)
+		}
+		pred.value = s[pos : pos+end]
+		pos += end
+	} else {
+		if s[pos] != '\'' && s[pos] != '"' {
+			return predicate{}, 0, fmt.Errorf("predicate value must be quoted with ' or \" in %s", shown)
+		}
+
+		quote := s[pos]
+		closing := strings.IndexByte(s[pos+1:], quote)
+		if closing < 0 {
+			return predicate{}, 0, fmt.Errorf("missing closing quote in predicate %s", shown)
+		}
+		pred.value = s[pos+1 : pos+1+closing]
+		pos += closing + 2
+	}
+
+	if numeric {
+		n, err := strconv.ParseFloat(strings.TrimSpace(pred.value), 64)
+		if err != nil {
+			return predicate{}, 0, fmt.Errorf("%s needs a number in predicate %s; compare strings with = or != instead", pred.cmp, shown)
+		}
+		pred.number = n
+	}
+
+	if pos == len(s) || s[pos] != ']' {
+		return predicate{}, 0, fmt.Errorf("expected ] after the value in predicate %s; for several conditions, use one predicate for each, as in [@a='1'][@b='2']", s[:pos])
+	}
+
+	return pred, pos + 1, nil
+}
+
+// matchesElementName is like matchesName, but optionally ignores case
+func matchesElementName(raw xml.Name, name string, ignoreCase bool) bool {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return equalName(raw.Space, name[:i], ignoreCase) && equalName(raw.Local, name[i+1:], ignoreCase)
+	}
+	return equalName(raw.Local, name, ignoreCase)
+}
+
+func equalName(a, b string, ignoreCase bool) bool {
+	if ignoreCase {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// matches reports whether the element path, given as the list of
+// elements from the root, matches the pattern steps
+func (m *Modification) matches(path []element) bool {
+	return matchSteps(m.path, path, m.IgnoreCase)
+}
+
+// exact reports whether the modification path has no descendant
+// steps, i.e. it can only match elements at one specific depth
+func (m *Modification) exact() bool {
+	for _, s := range m.path {
+		if s.descendant {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSteps matches the path against the steps, backtracking over
+// the number of elements skipped by descendant steps
+func matchSteps(steps []step, path []element, ignoreCase bool) bool {
+	if len(steps) == 0 {
+		return len(path) == 0
+	}
+
+	s := steps[0]
+	if !s.descendant {
+		return len(path) > 0 && s.matches(path[0], ignoreCase) && matchSteps(steps[1:], path[1:], ignoreCase)
+	}
+
+	for skip := 0; skip < len(path); skip++ {
+		if s.matches(path[skip], ignoreCase) && matchSteps(steps[1:], path[skip+1:], ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns the modifications matching the element path.  If
+// both an exact path and a descendant path change the value of the
+// same attribute with the same operation, only the exact ones are
+// returned so the exact pattern takes precedence regardless of the
+// order they were given in.  Other modifications, such as those of the
+// element as a whole, are always returned.
+func matching(modifications []Modification, path []element) []*Modification {
+	type opAttr struct {
+		op        operation
+		attribute string
+	}
+
+	var matched []*Modification
+	exact := make(map[opAttr]bool)
+	for i := range modifications {
+		pat := &modifications[i]
+		if pat.matches(path) {
+			matched = append(matched, pat)
+			if pat.exact() {
+				exact[opAttr{pat.op, pat.attribute}] = true
+			}
+		}
+	}
+
+	result := matched[:0]
+	for _, pat := range matched {
+		if pat.exact() || !pat.changesValue() || !exact[opAttr{pat.op, pat.attribute}] {
+			result = append(result, pat)
+		}
+	}
+	return result
+}
+
+// changesValue reports whether the modification changes the value of
+// an attribute, see matching
+func (m *Modification) changesValue() bool {
+	switch m.op {
+	case opSet, opAppend, opReplace, opRemove:
+		return true
+	}
+	return false
+}
+
+// ParseModifications parses modification strings to structs:
+//
+//	/foo/*/bar[@id='x']@attr=val
+//
+// parses to:
+//
+//	path:      /foo/*/bar (where * matches any element name, and
+//	           bar must have an id attribute with the value x)
+//	attribute: attr
+//	value:     val
+//
+// while /foo/bar@attr+=text appends text to the value as is,
+// /foo/bar@attr-=text removes every occurrence of text from the value,
+// /foo/bar@attr~=s/re/repl/ replaces matches of the regular
+// expression re in the value, /foo/bar@attr! deletes attr,
+// /foo/bar@attr~name renames attr to name, /foo/bar~name renames bar
+// elements to name and /foo/bar! deletes bar elements including their
+// children.
+//
+// With Increment, /foo/bar@attr+=1 adds 1 to the integer value of
+// attr instead, and /foo/bar@attr-=1 subtracts 1 from it.
+//
+// /foo/bar+=<baz/> inserts the XML fragment <baz/> as the last child of
+// bar elements, indented like the other children.
+//
+// /foo/comment()~=s/re/repl/ replaces matches of re in the text of
+// comments which are direct children of foo elements, while
+// /foo//comment()~=s/re/repl/ also applies to comments at any depth
+// below foo, and //comment()~=s/re/repl/ to all comments.
+//
+// A guard such as /foo/bar@attr[==old]=val only modifies attr where its
+// current value is old.
+//
+// A comma separated list of attributes, as in /foo/bar@a,b=val, gives
+// one modification for each attribute, all with the same Pattern.
+func ParseModifications(modStrings []string) ([]Modification, error) {
+	var modifications []Modification
+	for _, mod := range modStrings {
+		m, err := parseModification(mod)
+		if err != nil {
+			return nil, fmt.Errorf(`Invalid mod "%s": %v`, mod, err)
+		}
+		m.Pattern = mod
+		modifications = append(modifications, splitAttributes(m)...)
+	}
+
+	return modifications, nil
+}
+
+// ParseModsFile parses modifications from r, with one pattern per
+// line.  Leading and trailing whitespace is ignored, as are blank lines
+// and lines starting with #.  Errors include name and the line number.
+func ParseModsFile(r io.Reader, name string) ([]Modification, error) {
+	var modifications []Modification
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parseModification(line)
+		if err != nil {
+			return nil, fmt.Errorf(`%s:%d: Invalid mod "%s": %v`, name, lineno, line, err)
+		}
+		m.Pattern = line
+		modifications = append(modifications, splitAttributes(m)...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return modifications, nil
+}
+
+// ParseValueMap parses a mapping of attribute values from r, with one
+// old=new pair per line, into a modification replacing any attribute
+// value which is exactly old with new, in all elements.  Namespace
+// declarations are not changed.  Leading and trailing whitespace is
+// ignored, as are blank lines and lines starting with #.  An = in old
+// is written as \=.  Values are replaced at once, so with a=b and b=c,
+// a becomes b rather than c.  The Pattern of the modification is name, and
+// errors include name and the line number.
+func ParseValueMap(r io.Reader, name string) (Modification, error) {
+	mapping := make(map[string]string)
+	lines := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		eq := unescapedIndex(line, '=')
+		if eq <= 0 {
+			return Modification{}, fmt.Errorf("%s:%d: expected old=new, got %s", name, lineno, line)
+		}
+		old := unescape(line[:eq], "=")
+		if first, ok := lines[old]; ok {
+			return Modification{}, fmt.Errorf("%s:%d: %s is already mapped on line %d", name, lineno, old, first)
+		}
+		mapping[old] = line[eq+1:]
+		lines[old] = lineno
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Modification{}, fmt.Errorf("%s: %v", name, err)
+	}
+
+	path, _, err := parsePath("//*")
+	if err != nil {
+		return Modification{}, err
+	}
+	return Modification{Pattern: name, path: path, op: opMapValues, mapping: mapping}, nil
+}
+
+// ExpandEnv expands environment variable references written as $VAR or
+// ${VAR} in the values of set, append and subtract modifications, with
+// $$ giving a literal $.  Each reference is replaced independently
+// from left to right, and the result is not expanded again, so a
+// variable containing $ is kept as is.  Unset variables are an error
+// unless allowUnset is set, in which case they expand to the empty
+// string.
+func ExpandEnv(modifications []Modification, allowUnset bool) error {
+	for i := range modifications {
+		m := &modifications[i]
+		if m.op != opSet && m.op != opAppend && m.op != opRemove {
+			continue
+		}
+
+		var unset []string
+		m.value = os.Expand(m.value, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				unset = append(unset, name)
+			}
+			return value
+		})
+
+		if len(unset) != 0 && !allowUnset {
+			return fmt.Errorf(`Invalid mod "%s": environment variable %s is not set`, m.Pattern, strings.Join(unset, ", "))
+		}
+	}
+
+	return nil
+}
+
+// CheckIncrements returns an error if a += or -= modification with
+// Increment does not change the value by an integer.  Call it after
+// ExpandEnv and setting Increment.
+func CheckIncrements(modifications []Modification) error {
+	for _, m := range modifications {
+		if !m.Increment || (m.op != opAppend && m.op != opRemove) {
+			continue
+		}
+		if _, err := strconv.ParseInt(m.value, 10, 64); err != nil {
+			return fmt.Errorf(`Invalid mod "%s": "%s" is not an integer to add or subtract`, m.Pattern, m.value)
+		}
+	}
+	return nil
+}
+
+// BindNamespaces makes element and attribute names with a prefix in
+// namespaces match by the namespace URI instead of literally, so with
+// soap bound to the SOAP envelope URI, /soap:Envelope matches the same
+// elements as /{http://schemas.xmlsoap.org/soap/envelope/}Envelope,
+// whatever prefix the document declares for it, and soap:* any element
+// in the namespace.  Likewise, with xsi bound to the XML Schema
+// instance URI, @xsi:type matches the type attribute in that namespace
+// with any prefix, also in predicates.  Names with a prefix which is
+// not bound still match the prefix as written.
+func BindNamespaces(modifications []Modification, namespaces map[string]string) {
+	for i := range modifications {
+		m := &modifications[i]
+		m.attrNamespace, m.attrByNamespace = boundNamespace(m.attribute, namespaces)
+		for j := range m.path {
+			s := &m.path[j]
+			for k := range s.predicates {
+				p := &s.predicates[k]
+				if p.attribute != "" {
+					p.namespace, p.byNamespace = boundNamespace(p.attribute, namespaces)
+				}
+			}
+			i := strings.IndexByte(s.name, ':')
+			if i < 0 || i == len(s.name)-1 {
+				continue
+			}
+			uri, ok := namespaces[s.name[:i]]
+			if !ok {
+				continue
+			}
+			s.namespace = uri
+			s.byNamespace = true
+			s.name = s.name[i+1:]
+			if s.name == "*" {
+				s.wildcard = true
+				s.name = ""
+			}
+		}
+	}
+}
+
+// boundNamespace returns the URI bound in namespaces to the prefix of
+// the attribute name, and whether there is one
+func boundNamespace(name string, namespaces map[string]string) (string, bool) {
+	prefix, _, found := strings.Cut(name, ":")
+	if !found {
+		return "", false
+	}
+	uri, ok := namespaces[prefix]
+	return uri, ok
+}
+
+// A ValueType is the expected type of the value of a set
+// modification, see CheckTypes
+type ValueType int
+
+const (
+	TypeAny   ValueType = iota // any value
+	TypeInt                    // a decimal integer, such as -42
+	TypeBool                   // true, false, 1 or 0, as in XML Schema
+	TypeFloat                  // a decimal or scientific number, such as 1.5e3
+)
+
+// String returns the name of the type, as used in error messages
+func (t ValueType) String() string {
+	switch t {
+	case TypeInt:
+		return "integer"
+	case TypeBool:
+		return "boolean"
+	case TypeFloat:
+		return "number"
+	}
+	return "any"
+}
+
+// CheckTypes returns an error if the value of a modification with a
+// Type is not of that type.  Call it after ExpandEnv and
+// ReadValueFiles to check the final values.  Types can only be given
+// for set modifications.
+func CheckTypes(modifications []Modification) error {
+	for i := range modifications {
+		m := &modifications[i]
+		if m.Type == TypeAny {
+			continue
+		}
+		if m.op != opSet {
+			return fmt.Errorf(`Invalid mod "%s": the type of a value can only be checked for values set with =`, m.Pattern)
+		}
+
+		var err error
+		switch m.Type {
+		case TypeInt:
+			_, err = strconv.ParseInt(m.value, 10, 64)
+		case TypeBool:
+			if m.value != "true" && m.value != "false" && m.value != "1" && m.value != "0" {
+				err = errors.New("invalid syntax")
+			}
+		case TypeFloat:
+			_, err = strconv.ParseFloat(m.value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf(`Invalid mod "%s": value "%s" is not a valid %s`, m.Pattern, m.value, m.Type)
+		}
+	}
+
+	return nil
+}
+
+// ReadValueFiles replaces values of set and append modifications
+// given as @filename with the contents of the file.  The file name may
+// refer to environment variables expanded by ExpandEnv, but values
+// which only start with @ after expanding variables are kept as they
+// are.  A single trailing newline is removed unless keepNewline is set.
+// A value given as \@text is the literal text @text.
+func ReadValueFiles(modifications []Modification, keepNewline bool) error {
+	for i := range modifications {
+		m := &modifications[i]
+		if !m.file {
+			continue
+		}
+
+		contents, err := os.ReadFile(m.value[1:])
+		if err != nil {
+			return fmt.Errorf(`Invalid mod "%s": could not read value: %v`, m.Pattern, err)
+		}
+
+		m.value = string(contents)
+		m.file = false
+		if !keepNewline && strings.HasSuffix(m.value, "\n") {
+			m.value = strings.TrimSuffix(m.value[:len(m.value)-1], "\r")
+		}
+	}
+
+	return nil
+}
+
+// parseModification parses a single modification string, see
+// ParseModifications
+func parseModification(mod string) (Modification, error) {
+	// input: /foo/bar@attr=val
+
+	// /foo/bar, @attr=val
+	path, rest, err := parsePath(mod)
+	if err != nil {
+		return Modification{}, err
+	}
+	m := Modification{path: path}
+
+	if path[len(path)-1].comment {
+		if !strings.HasPrefix(rest, "~=") {
+			return Modification{}, errors.New("comments can only be modified with comment()~=s/regexp/replacement/")
+		}
+		m.op = opEditComment
+		m.re, m.value, err = parseSubstitution(rest[2:])
+		if err != nil {
+			return Modification{}, err
+		}
+		return m, nil
+	}
+
+	if rest == "!" {
+		m.op = opDeleteElement
+		return m, nil
+	}
+
+	if strings.HasPrefix(rest, "+=") {
+		if err := checkFragment(rest[2:]); err != nil {
+			return Modification{}, err
+		}
+		m.op = opInsert
+		m.value = rest[2:]
+		return m, nil
+	}
+
+	if strings.HasPrefix(rest, "~") {
+		if rest == "~" {
+			return Modification{}, errors.New("missing new element name after ~")
+		}
+		if !validName(rest[1:]) {
+			return Modification{}, fmt.Errorf("invalid new element name %s", rest[1:])
+		}
+		m.op = opRenameElement
+		m.value = rest[1:]
+		return m, nil
+	}
+
+	if !strings.HasPrefix(rest, "@") {
+		return Modification{}, errModSyntax
+	}
+
+	// @attr[==old]=val
+	if i := strings.Index(rest, "[=="); i >= 0 && !strings.Contains(rest[:i], "=") {
+		end := unescapedIndex(rest[i:], ']')
+		if end < 0 {
+			return Modification{}, fmt.Errorf("unterminated guard %s", rest[i:])
+		}
+		guard := unescape(rest[i+3:i+end], "@=]")
+		m.guard = &guard
+		rest = rest[:i] + rest[i+end+1:]
+	}
+
+	// attr, val
+	attrValue := strings.SplitN(rest[1:], "=", 2)
+	attr := attrValue[0]
+
+	switch {
+	case len(attrValue) == 2 && strings.HasSuffix(attr, "~"):
+		m.attribute = strings.TrimSuffix(attr, "~")
+		m.op = opReplace
+		m.re, m.value, err = parseSubstitution(attrValue[1])
+		if err != nil {
+			return Modification{}, err
+		}
+
+	case len(attrValue) == 2 && strings.HasSuffix(attr, "-"):
+		m.attribute = strings.TrimSuffix(attr, "-")
+		m.op = opRemove
+		m.value = unescape(attrValue[1], "@=")
+		if m.value == "" {
+			return Modification{}, errors.New("missing text to remove after -=")
+		}
+
+	case len(attrValue) == 2 && strings.HasSuffix(attr, "+"):
+		m.attribute = strings.TrimSuffix(attr, "+")
+		m.op = opAppend
+		m.value, m.file = parseValue(attrValue[1])
+
+	case len(attrValue) == 2:
+		m.attribute = attr
+		m.op = opSet
+		m.value, m.file = parseValue(attrValue[1])
+
+	case strings.HasSuffix(attr, "!"):
+		m.attribute = strings.TrimSuffix(attr, "!")
+		m.op = opDelete
+
+	case strings.Contains(attr, "~"):
+		oldNew := strings.SplitN(attr, "~", 2)
+		if oldNew[1] == "" {
+			return Modification{}, fmt.Errorf("missing new name for attribute %s", oldNew[0])
+		}
+		if !validName(oldNew[1]) {
+			return Modification{}, fmt.Errorf("invalid new name %s for attribute %s", oldNew[1], oldNew[0])
+		}
+		m.attribute = oldNew[0]
+		m.op = opRename
+		m.value = oldNew[1]
+
+	case validAttrName(attr):
+		m.attribute = attr
+		m.op = opGet
+
+	default:
+		return Modification{}, errModSyntax
+	}
+
+	if m.attribute == "" {
+		return Modification{}, errModSyntax
+	}
+
+	if strings.Contains(m.attribute, ",") && m.op == opRename {
+		return Modification{}, errors.New("cannot rename more than one attribute")
+	}
+	for _, a := range strings.Split(m.attribute, ",") {
+		if a == "" {
+			return Modification{}, fmt.Errorf("empty attribute name in %s", m.attribute)
+		}
+		if !validName(a) {
+			return Modification{}, fmt.Errorf("invalid attribute name %s", a)
+		}
+	}
+
+	if m.guard != nil && m.op == opGet {
+		return Modification{}, errors.New("a guard [==value] requires a modification of the attribute")
+	}
+
+	return m, nil
+}
+
+// parseValue returns the value of a set or append modification, and
+// whether it is of the form @filename, to be read by ReadValueFiles.
+// This is decided from the value as written, before unescaping \@ and
+// rather than after ExpandEnv, so neither an escaped @ nor environment
+// variables make a value be read from a file.
+func parseValue(s string) (string, bool) {
+	return unescape(s, "@="), strings.HasPrefix(s, "@")
+}
+
+// unescape removes a backslash before any of the characters in
+// special.  Other backslashes are kept, so values such as Windows
+// paths need no escaping.
+func unescape(s, special string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(special, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// unescapedIndex returns the index of the first c in s which is not
+// preceded by a backslash, or -1
+func unescapedIndex(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+// checkFragment returns an error unless fragment is well-formed XML
+// content, such as one or more elements
+func checkFragment(fragment string) error {
+	if strings.TrimSpace(fragment) == "" {
+		return errors.New("missing XML fragment to insert after +=")
+	}
+
+	d := xml.NewDecoder(strings.NewReader(fragment))
+	var open []xml.Name
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid XML fragment: %v", err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			open = append(open, tok.Name)
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != tok.Name {
+				return fmt.Errorf("invalid XML fragment: unexpected end tag </%s>", qualifiedName(tok.Name))
+			}
+			open = open[:len(open)-1]
+		case xml.ProcInst:
+			if tok.Target == "xml" {
+				return errors.New("invalid XML fragment: unexpected XML declaration")
+			}
+		case xml.Directive:
+			return errors.New("invalid XML fragment: unexpected directive")
+		}
+	}
+
+	if len(open) != 0 {
+		return fmt.Errorf("invalid XML fragment: missing end tag </%s>", qualifiedName(open[len(open)-1]))
+	}
+	return nil
+}
+
+// splitAttributes returns a copy of the modification for each of the
+// attributes in a comma separated list
+func splitAttributes(m Modification) []Modification {
+	names := strings.Split(m.attribute, ",")
+	split := make([]Modification, len(names))
+	for i, name := range names {
+		split[i] = m
+		split[i].attribute = name
+	}
+	return split
+}
+
+// validAttrName reports whether name looks like an attribute name,
+// with an optional prefix, rather than a malformed operation
+func validAttrName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "!~=@[]/$ ")
+}
+
+// validName reports whether name is an XML name with an optional
+// prefix, as in prefix:local
+func validName(name string) bool {
+	prefix, local, found := strings.Cut(name, ":")
+	if !found {
+		return isNCName(name)
+	}
+	return isNCName(prefix) && isNCName(local)
+}
+
+// isNCName reports whether s is an XML name without a colon: a letter
+// or _, followed by letters, digits, combining marks, _, -, . and ·
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || r == '\u00b7' || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var errModSyntax = errors.New("expected syntax /xml/path@attr=newValue, /xml/path@attr+=text, /xml/path@attr-=text, /xml/path@attr~=s/regexp/replacement/, /xml/path@attr!, /xml/path@attr~newName, /xml/path~newName or /xml/path!")
+
+// parseSubstitution parses a substitution of the form s/re/repl/.
+// Any character following s may be used as the delimiter instead of /,
+// and the delimiter can be escaped with a backslash inside re and repl.
+func parseSubstitution(sub string) (*regexp.Regexp, string, error) {
+	if len(sub) < 2 || sub[0] != 's' {
+		return nil, "", fmt.Errorf("expected substitution of the form s/regexp/replacement/, got %s", sub)
+	}
+
+	delim := sub[1:2]
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(sub); i++ {
+		switch {
+		case sub[i] == '\\' && strings.HasPrefix(sub[i+1:], delim):
+			part.WriteString(delim)
+			i++
+		case sub[i:i+1] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(sub[i])
+		}
+	}
+
+	if len(parts) != 2 || part.Len() != 0 {
+		return nil, "", fmt.Errorf("expected substitution of the form s%[1]sregexp%[1]sreplacement%[1]s, got %[2]s", delim, sub)
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid regular expression in %s: %v", sub, err)
+	}
+
+	return re, parts[1], nil
+}
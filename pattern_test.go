@@ -0,0 +1,178 @@
+package xmlfrob
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchingPrecedence(t *testing.T) {
+	tests := []struct {
+		input string
+		mods  []string
+		want  string
+	}{
+		{`<r><b x="1"/></r>`, []string{"//b@x=d", "/r/b@x=e"}, `<r><b x="e"/></r>`},
+		{`<r><b x="1"/></r>`, []string{"/r/b@x=e", "//b@x=d"}, `<r><b x="e"/></r>`},
+		{`<r><b x="1"/></r>`, []string{"/r/b@x+=e", "//b@x+=d"}, `<r><b x="1e"/></r>`},
+		{`<r><b x="1"/></r>`, []string{"/r/b@x=e", "//b@x+=d"}, `<r><b x="ed"/></r>`},
+		{`<r><b x="1" y="2"/></r>`, []string{"/r/b@x=e", "//b@y=d"}, `<r><b x="e" y="d"/></r>`},
+		{`<r><b/></r>`, []string{"/r/b+=<q/>", "//b~d"}, `<r><d><q/></d></r>`},
+		{`<r><b x="1"/></r>`, []string{"//b~d", "/r/b@x=e"}, `<r><d x="e"/></r>`},
+	}
+	for _, test := range tests {
+		got, err := frob(t, test.input, test.mods, nil, nil)
+		if err != nil || got != test.want {
+			t.Errorf("%q on %s: got %q, %v; want %q", test.mods, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestRootAttribute(t *testing.T) {
+	tests := []frobTest{
+		{`<project version="1"/>`, []string{"/project@version=2"}, `<project version="2"/>`},
+		{`<project version="1"/>`, []string{"/@version=2"}, `<project version="2"/>`},
+		{`<pom version="1"/>`, []string{"/@version=2"}, `<pom version="2"/>`},
+		{`<pom version="1"/>`, []string{"/project@version=2"}, `<pom version="1"/>`},
+		{`<project><project version="1"/></project>`, []string{"/project@version=2"}, `<project><project version="1"/></project>`},
+		{`<project><project version="1"/></project>`, []string{"/@version=2"}, `<project><project version="1"/></project>`},
+		{`<?xml version="1.0"?><!-- c --><project a="1"/>`, []string{"/project@version=2"}, `<?xml version="1.0"?><!-- c --><project a="1"/>`},
+		{`<?xml version="1.0"?><!-- c --><project a="1"/>`, []string{"/project@a=2"}, `<?xml version="1.0"?><!-- c --><project a="2"/>`},
+	}
+	testFrob(t, tests, nil)
+
+	for _, mod := range []string{"/@x[==1]=2", "/@x!", "/@x~y"} {
+		if _, err := parseModification(mod); err != nil {
+			t.Errorf("%s: %v", mod, err)
+		}
+	}
+}
+
+func TestParseEscapes(t *testing.T) {
+	tests := []struct {
+		mod       string
+		path      string
+		attribute string
+		value     string
+	}{
+		{`/a@x=b=c`, "a", "x", "b=c"},
+		{`/a@x=b@c`, "a", "x", "b@c"},
+		{`/a@x=user\@host`, "a", "x", "user@host"},
+		{`/a@x=\=`, "a", "x", "="},
+		{`/a@x=C:\temp\dir`, "a", "x", `C:\temp\dir`},
+		{`/a@x=\\@`, "a", "x", `\@`},
+		{`/a@x+=\@b`, "a", "x", "@b"},
+		{`/a\@b@x=1`, "a@b", "x", "1"},
+		{`/a\[1\]@x=1`, "a[1]", "x", "1"},
+		{`/a@x=p@q=r`, "a", "x", "p@q=r"},
+	}
+	for _, test := range tests {
+		m, err := parseModification(test.mod)
+		if err != nil {
+			t.Errorf("%s: %v", test.mod, err)
+			continue
+		}
+		if name := m.path[len(m.path)-1].name; name != test.path || m.attribute != test.attribute || m.value != test.value {
+			t.Errorf("%s: parsed to element %q, attribute %q, value %q; want %q, %q, %q", test.mod, name, m.attribute, m.value, test.path, test.attribute, test.value)
+		}
+	}
+}
+
+func TestParseGuardEscapes(t *testing.T) {
+	tests := []struct {
+		mod   string
+		guard string
+		value string
+	}{
+		{`/a@x[==1]=2`, "1", "2"},
+		{`/a@x[==a\]b]=c`, "a]b", "c"},
+		{`/a@x[==a\=b]=c=d`, "a=b", "c=d"},
+		{`/a@x[==u\@h]=v`, "u@h", "v"},
+		{`/a@x[==]=v`, "", "v"},
+	}
+	for _, test := range tests {
+		m, err := parseModification(test.mod)
+		if err != nil {
+			t.Errorf("%s: %v", test.mod, err)
+			continue
+		}
+		if m.guard == nil || *m.guard != test.guard || m.value != test.value {
+			t.Errorf("%s: parsed to guard %v, value %q; want %q, %q", test.mod, m.guard, m.value, test.guard, test.value)
+		}
+	}
+}
+
+func TestParseGuardErrors(t *testing.T) {
+	for _, mod := range []string{`/a@x[==1=2`, `/a@x[==1]`} {
+		if _, err := parseModification(mod); err == nil {
+			t.Errorf("%s: no error", mod)
+		}
+	}
+}
+
+func TestParseAttributeNames(t *testing.T) {
+	for _, mod := range []string{"/a@y=2", "/a@_y.1-2=2", "/a@xsi:type=b", "/a@xmlns:p=u", "/a@æø=1", "/a@x,y+=1", "/a@y!"} {
+		if _, err := parseModification(mod); err != nil {
+			t.Errorf("%s: %v", mod, err)
+		}
+	}
+	for _, mod := range []string{"/a@y z=2", "/a@1y=2", "/a@-y+=2", "/a@y:=2", "/a@:y!", "/a@a:b:c=1", "/a@x,1y=2"} {
+		if _, err := parseModification(mod); err == nil {
+			t.Errorf("%s: no error", mod)
+		}
+	}
+}
+
+func TestParseElementRename(t *testing.T) {
+	for _, mod := range []string{"/r/a~b", "/r/a~p:b", "/r/a~b-c.d"} {
+		if _, err := parseModification(mod); err != nil {
+			t.Errorf("%s: %v", mod, err)
+		}
+	}
+	for _, mod := range []string{"/r/a~1bad", "/r/a~b c", "/r/a~b>", "/r/a~:b"} {
+		if _, err := parseModification(mod); err == nil {
+			t.Errorf("%s: no error", mod)
+		}
+	}
+}
+
+func TestReadValueFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "value")
+	if err := os.WriteFile(file, []byte("from file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DIR", dir)
+	t.Setenv("V", "@"+file)
+
+	tests := []struct {
+		mod   string
+		value string
+	}{
+		{"/a@x=@" + file, "from file"},
+		{"/a@x+=@" + file, "from file"},
+		{"/a@x=@$DIR/value", "from file"},
+		{"/a@x=$V", "@" + file},
+		{"/a@x=${V}", "@" + file},
+		{`/a@x=\@text`, "@text"},
+		{`/a@x=\@` + file, "@" + file},
+		{`/a@x+=\@` + file, "@" + file},
+		{"/a@x=a@b", "a@b"},
+	}
+	for _, test := range tests {
+		mods, err := ParseModifications([]string{test.mod})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ExpandEnv(mods, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReadValueFiles(mods, false); err != nil {
+			t.Errorf("%s: %v", test.mod, err)
+			continue
+		}
+		if mods[0].value != test.value {
+			t.Errorf("%s: got value %q, want %q", test.mod, mods[0].value, test.value)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package xmlfrob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Quote selects the quote character used around attribute values in
+// the output
+type Quote int
+
+const (
+	QuotePreserve Quote = iota // use the quote character of the input
+	QuoteDouble                // always use "
+	QuoteSingle                // always use '
+)
+
+// EOL selects the line endings used in the output
+type EOL int
+
+const (
+	EOLPreserve EOL = iota // keep the line endings of the input
+	EOLLF                  // convert all line endings to \n
+	EOLCRLF                // convert all line endings to \r\n
+)
+
+// Empty selects how elements without content are written
+type Empty int
+
+const (
+	EmptyCollapse Empty = iota // always as self-closing tags, <a/>
+	EmptyExpand                // always as start and end tags, <a></a>
+	EmptyPreserve              // as in the input
+)
+
+// eolWriter converts \n and \r\n line endings written to it to
+// newline.  A \r at the end of a write is held back until the next
+// write or flush, as it may start a \r\n.
+type eolWriter struct {
+	w       io.Writer
+	newline string
+	cr      bool
+}
+
+// newEOLWriter returns an eolWriter converting the line endings
+// written to w for mode, or nil for EOLPreserve
+func newEOLWriter(w io.Writer, mode EOL) *eolWriter {
+	switch mode {
+	case EOLLF:
+		return &eolWriter{w: w, newline: "\n"}
+	case EOLCRLF:
+		return &eolWriter{w: w, newline: "\r\n"}
+	}
+	return nil
+}
+
+func (e *eolWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+len(p)/8)
+	for _, c := range p {
+		if e.cr {
+			e.cr = false
+			if c == '\n' {
+				out = append(out, e.newline...)
+				continue
+			}
+			out = append(out, '\r')
+		}
+
+		switch c {
+		case '\r':
+			e.cr = true
+		case '\n':
+			out = append(out, e.newline...)
+		default:
+			out = append(out, c)
+		}
+	}
+
+	if _, err := e.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes a held back \r
+func (e *eolWriter) flush() error {
+	if !e.cr {
+		return nil
+	}
+	e.cr = false
+	_, err := e.w.Write([]byte{'\r'})
+	return err
+}
+
+// recorder is an io.ByteReader keeping the bytes read since the last
+// call to raw, so the raw input of each token can be recovered from
+// the offsets reported by the decoder
+type recorder struct {
+	r    *bufio.Reader
+	buf  []byte
+	base int64 // input offset of buf[0]
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+func (r *recorder) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.buf = append(r.buf, b)
+	}
+	return b, err
+}
+
+// raw returns the input from the end of the previous token to offset,
+// and forgets it.  The result is only valid until the next read.
+func (r *recorder) raw(offset int64) []byte {
+	n := int(offset - r.base)
+	raw := r.buf[:n]
+	r.buf = append(r.buf[:0:0], r.buf[n:]...)
+	r.base = offset
+	return raw
+}
+
+// cdataStart starts a CDATA section in the raw input
+var cdataStart = []byte("<![CDATA[")
+
+// utf8BOM is the UTF-8 encoding of the byte order mark U+FEFF
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// skipBOM reads a UTF-8 byte order mark at the start of r, if any, and
+// reports whether there was one
+func skipBOM(r *bufio.Reader) (bool, error) {
+	start, err := r.Peek(len(utf8BOM))
+	if !bytes.Equal(start, utf8BOM) {
+		if err == io.EOF {
+			err = nil
+		}
+		return false, err
+	}
+	_, err = r.Discard(len(utf8BOM))
+	return true, err
+}
+
+// an attr is an attribute of a start tag along with the quote
+// character used for it in the input, or 0 for new attributes.  space
+// is the whitespace before the name and eq the text from the end of
+// the name to the quote, normally just =.  Both are empty for new
+// attributes.  raw is the value as written in the input, with entity
+// references, and orig the value it decodes to, so the raw value can
+// be written as long as the value is not modified.  namespace is the
+// URI of the prefix, see attrNamespace.
+type attr struct {
+	xml.Attr
+	quote     byte
+	space     string
+	eq        string
+	raw       string
+	orig      string
+	namespace string
+}
+
+// tagAttrs returns the attributes of a start element along with the
+// quote characters and spacing used in the raw start tag, and the
+// whitespace before the closing > or />
+func tagAttrs(tok xml.StartElement, raw []byte) ([]attr, string) {
+	layout, tail := parseTag(raw)
+	attrs := make([]attr, len(tok.Attr))
+	for i, a := range tok.Attr {
+		attrs[i].Attr = a
+		if i < len(layout) {
+			attrs[i].quote = layout[i].quote
+			attrs[i].space = layout[i].space
+			attrs[i].eq = layout[i].eq
+			attrs[i].raw = layout[i].raw
+			attrs[i].orig = a.Value
+		}
+	}
+	return attrs, tail
+}
+
+// parseTag returns the layout of each attribute of a raw start tag, in
+// order, with the raw name, and the whitespace before the closing > or
+// />.  The values are not decoded, see tagAttrs.
+func parseTag(raw []byte) ([]attr, string) {
+	var layout []attr
+	i := 1 // skip <
+	for i < len(raw) && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+
+	for {
+		start := i
+		for i < len(raw) && isSpace(raw[i]) {
+			i++
+		}
+		if i == len(raw) || raw[i] == '/' || raw[i] == '>' {
+			return layout, string(raw[start:i])
+		}
+		a := attr{space: string(raw[start:i])}
+
+		// name = value
+		for i < len(raw) && raw[i] != '=' && !isSpace(raw[i]) {
+			i++
+		}
+		a.Name = rename(xml.Name{}, string(raw[start+len(a.space):i]))
+		eq := i
+		for i < len(raw) && raw[i] != '=' {
+			i++
+		}
+		i++
+		for i < len(raw) && isSpace(raw[i]) {
+			i++
+		}
+		if i >= len(raw) {
+			return layout, ""
+		}
+
+		a.quote = raw[i]
+		if a.quote != '"' && a.quote != '\'' {
+			return layout, ""
+		}
+		a.eq = string(raw[eq:i])
+
+		i++
+		start = i
+		for i < len(raw) && raw[i] != a.quote {
+			i++
+		}
+		a.raw = string(raw[start:i])
+		layout = append(layout, a)
+		i++
+	}
+}
+
+// doctypeEntities returns the general entities declared with a
+// literal value in the internal subset of a DOCTYPE directive.
+// Parameter entities and external entities are not included.
+func doctypeEntities(directive []byte) map[string]string {
+	if !bytes.HasPrefix(directive, []byte("DOCTYPE")) {
+		return nil
+	}
+
+	var entities map[string]string
+	rest := directive
+	for {
+		i := bytes.Index(rest, []byte("<!ENTITY"))
+		if i < 0 {
+			return entities
+		}
+		rest = rest[i+len("<!ENTITY"):]
+
+		j := 0
+		for j < len(rest) && isSpace(rest[j]) {
+			j++
+		}
+		if j == len(rest) || rest[j] == '%' {
+			continue
+		}
+
+		start := j
+		for j < len(rest) && !isSpace(rest[j]) && rest[j] != '"' && rest[j] != '\'' {
+			j++
+		}
+		name := string(rest[start:j])
+		for j < len(rest) && isSpace(rest[j]) {
+			j++
+		}
+		if name == "" || j == len(rest) || (rest[j] != '"' && rest[j] != '\'') {
+			continue
+		}
+
+		quote := rest[j]
+		end := bytes.IndexByte(rest[j+1:], quote)
+		if end < 0 {
+			return entities
+		}
+		if entities == nil {
+			entities = make(map[string]string)
+		}
+		entities[name] = entityText(rest[j+1 : j+1+end])
+		rest = rest[j+1+end:]
+	}
+}
+
+// entityText returns the replacement text of an entity value, with
+// character and predefined entity references resolved.  The value is
+// returned as is if it is not valid text.
+func entityText(value []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(append(append([]byte("<e>"), value...), "</e>"...)))
+	var text []byte
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return string(text)
+		}
+		if err != nil {
+			return string(value)
+		}
+		if data, ok := tok.(xml.CharData); ok {
+			text = append(text, data...)
+		}
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// qualifiedName returns the name as written in the input, with the
+// namespace prefix (RawToken does not translate prefixes to URIs)
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// isNamespaceDecl reports whether the raw attribute name is a
+// namespace declaration, xmlns or xmlns:prefix
+func isNamespaceDecl(name xml.Name) bool {
+	return name.Space == "xmlns" || (name.Space == "" && name.Local == "xmlns")
+}
+
+// sortAttrs sorts attributes by name, with namespace declarations
+// first: xmlns, then xmlns:prefix by prefix, followed by the other
+// attributes by their qualified name.  The whitespace before each
+// attribute stays in place, so attributes on separate lines stay on
+// separate lines.
+func sortAttrs(attrs []attr) {
+	spaces := make([]string, len(attrs))
+	for i, a := range attrs {
+		spaces[i] = a.space
+	}
+
+	sort.SliceStable(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if isNamespaceDecl(a.Name) != isNamespaceDecl(b.Name) {
+			return isNamespaceDecl(a.Name)
+		}
+		return qualifiedName(a.Name) < qualifiedName(b.Name)
+	})
+
+	for i := range attrs {
+		attrs[i].space = spaces[i]
+	}
+}
+
+// writeStartTag writes a start tag for name with the attributes,
+// keeping their spacing and, unless modified, their values as written
+// in the input, followed by tail and >.  New attributes are
+// written on a line of their own if the last attribute from the input
+// is.  For QuotePreserve, attributes without a quote character from
+// the input use the first quote character of the element, or def.
+func writeStartTag(w *bytes.Buffer, name xml.Name, attrs []attr, tail string, mode Quote, def byte) {
+	elementQuote := def
+	for _, a := range attrs {
+		if a.quote != 0 {
+			elementQuote = a.quote
+			break
+		}
+	}
+
+	newSpace := " "
+	for _, a := range attrs {
+		if a.space != "" {
+			newSpace = a.space
+		}
+	}
+	if !strings.Contains(newSpace, "\n") {
+		newSpace = " "
+	}
+
+	w.WriteByte('<')
+	w.WriteString(qualifiedName(name))
+	for _, a := range attrs {
+		quote := byte('"')
+		switch mode {
+		case QuoteSingle:
+			quote = '\''
+		case QuotePreserve:
+			quote = a.quote
+			if quote == 0 {
+				quote = elementQuote
+			}
+		}
+
+		space, eq := a.space, a.eq
+		if space == "" {
+			space = newSpace
+		}
+		if eq == "" {
+			eq = "="
+		}
+
+		w.WriteString(space)
+		w.WriteString(qualifiedName(a.Name))
+		w.WriteString(eq)
+		w.WriteByte(quote)
+		if a.quote == quote && a.Value == a.orig {
+			w.WriteString(a.raw)
+		} else {
+			newline, tab := literalSpace(a.raw)
+			escapeAttr(w, a.Value, quote, newline, tab)
+		}
+		w.WriteByte(quote)
+	}
+	w.WriteString(tail)
+	w.WriteByte('>')
+}
+
+// literalSpace returns how to write newlines and tabs in a modified
+// value of an attribute, given its raw value in the input, so values
+// with literal line breaks or tabs keep them.  newline is the line
+// ending used in raw, or empty to write newlines as references, and
+// tab whether to write tabs as they are.  Either is written as a
+// reference if raw also contains it as one, as the two differ after
+// attribute value normalization.
+func literalSpace(raw string) (newline string, tab bool) {
+	referenced := make(map[rune]bool)
+	rest := raw
+	for i := strings.Index(rest, "&#"); i >= 0; i = strings.Index(rest, "&#") {
+		rest = rest[i+2:]
+		end := strings.IndexByte(rest, ';')
+		if end < 0 {
+			break
+		}
+		var n int64
+		var err error
+		if strings.HasPrefix(rest, "x") {
+			n, err = strconv.ParseInt(rest[1:end], 16, 32)
+		} else {
+			n, err = strconv.ParseInt(rest[:end], 10, 32)
+		}
+		if err == nil {
+			referenced[rune(n)] = true
+		}
+	}
+
+	if !referenced['\n'] && !referenced['\r'] {
+		if strings.Contains(raw, "\r\n") {
+			newline = "\r\n"
+		} else if strings.Contains(raw, "\n") {
+			newline = "\n"
+		}
+	}
+	tab = !referenced['\t'] && strings.Contains(raw, "\t")
+	return newline, tab
+}
+
+// escapeAttr writes an attribute value escaped for use within quote.
+// Values are always plain text, so & is escaped even if it starts what
+// looks like an entity reference.  Newlines are written as newline
+// and tabs as they are if tab is set, and as references otherwise.
+func escapeAttr(w *bytes.Buffer, value string, quote byte, newline string, tab bool) {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '&':
+			w.WriteString("&amp;")
+		case c == '<':
+			w.WriteString("&lt;")
+		case c == '>':
+			w.WriteString("&gt;")
+		case c == '"' && quote == '"':
+			w.WriteString("&quot;")
+		case c == '\'' && quote == '\'':
+			w.WriteString("&apos;")
+		case c == '\n' && newline != "":
+			w.WriteString(newline)
+		case c == '\n':
+			w.WriteString("&#xA;")
+		case c == '\r':
+			w.WriteString("&#xD;")
+		case c == '\t' && tab:
+			w.WriteByte(c)
+		case c == '\t':
+			w.WriteString("&#x9;")
+		default:
+			w.WriteByte(c)
+		}
+	}
+}
@@ -1,279 +1,1776 @@
 /*
-xmlfrob implements a program for making minor modifications to XML
-files.
+Package xmlfrob makes minor modifications to XML documents, keeping
+the style, indentation and comments of the input.
 
-Goals:
+Modifications are given as patterns such as
 
- - more robust for XML files than sed
- - simpler than xsltproc
- - keep style, indentation and comments of original input file
+	/server/connector@port=8181
 
-Example:
-
-  <server>
-      <connector port="8080"/>
-  </server>
-
-  xmlfrob --inplace --input foo.xml /server/connector@port=8181
+which are parsed with ParseModifications and applied with Frobnicate.
+See the README for the full pattern syntax.
 */
-
-package main
+package xmlfrob
 
 import (
 	"bufio"
 	"bytes"
 	"encoding/xml"
-	"flag"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"unicode/utf8"
 )
 
-// a modification contains an element path, attribute name and the new
-// value for the attribute
-type modification struct {
-	path      string
-	attribute string
-	value     string
+// element is an element on the path from the root to the element
+// currently being processed, with the attributes as they were in the
+// input.  position is the 1-based position of the element among its
+// siblings with the same name, while childPosition counts siblings of
+// any name.  A comment is represented as an element with comment set,
+// following the elements it is nested in, when matching comment()
+// patterns.  namespace is the namespace URI of the element, resolved
+// from the xmlns declarations in scope, which are kept in ns by prefix
+// ("" for the default namespace).  If the element is renamed in the
+// output, outName is the name used for both the start and end tag.
+// indent is the indentation of the line with the start tag, if it
+// starts a line, and childIndent that of its last child starting a
+// line so far, including the newline.  inserts are the fragments to
+// insert before the end tag, and creates the modifications which may
+// have to create elements below it.
+type element struct {
+	comment       bool
+	qname         xml.Name // the raw name, with the namespace prefix
+	namespace     string
+	ns            map[string]string
+	attr          []xml.Attr
+	content       *content // the text and children, if needed, see lookahead
+	position      int
+	childPosition int
+	outName       *xml.Name
+	indent        string
+	childIndent   string
+	inserts       []string
+	creates       []creation
+}
+
+// siblings counts the children seen so far of an element, in total
+// and by name
+type siblings struct {
+	count  int
+	byName map[string]int
+}
+
+// add counts another child with the given name and returns its
+// position among siblings of the same name and among all siblings
+func (s *siblings) add(name string) (position, childPosition int) {
+	if s.byName == nil {
+		s.byName = make(map[string]int)
+	}
+	s.count++
+	s.byName[name]++
+	return s.byName[name], s.count
+}
+
+// a tracker keeps track of the path from the root to the current
+// element while walking a document.  The zero value is ready to use.
+type tracker struct {
+	path     []element
+	counters []siblings // children of the document and each element on path
+
+	// contents is the content of each element in document order,
+	// if known, and started the number of elements started so far
+	contents []*content
+	started  int
 }
 
-// parseModifications parses modification strings to structs:
-//
-//     /foo/bar@attr=val
-//
-// parses to:
-//     path:      /foo/bar
-//     attribute: attr
-//     value:     val
-func parseModifications(modStrings []string) ([]modification, error) {
-	modifications := make([]modification, len(modStrings))
-	for i, mod := range modStrings {
-		// input: /foo/bar@attr=val
+// push enters the element started by tok
+func (t *tracker) push(tok xml.StartElement) {
+	if t.counters == nil {
+		t.counters = []siblings{{}}
+	}
+
+	var ns map[string]string
+	if len(t.path) > 0 {
+		ns = t.path[len(t.path)-1].ns
+	}
+	ns = declareNamespaces(ns, tok.Attr)
+
+	var c *content
+	if t.started < len(t.contents) {
+		c = t.contents[t.started]
+	}
+	t.started++
 
-		// /foo/bar@attr, val
-		pathAttrValue := strings.SplitN(mod, "=", 2)
+	position, childPosition := t.counters[len(t.counters)-1].add(tok.Name.Local)
+	t.counters = append(t.counters, siblings{})
+	t.path = append(t.path, element{
+		qname:         tok.Name,
+		namespace:     ns[tok.Name.Space],
+		ns:            ns,
+		attr:          append([]xml.Attr(nil), tok.Attr...),
+		content:       c,
+		position:      position,
+		childPosition: childPosition,
+	})
+}
 
-		// /foo/bar, attr
-		pathAttr := strings.SplitN(pathAttrValue[0], "@", 2)
+// skip counts an element which is not entered, such as one inside a
+// deleted element, to keep contents in step with the document
+func (t *tracker) skip() {
+	t.started++
+}
 
-		if len(pathAttrValue) != 2 || len(pathAttr) != 2 {
-			return nil, fmt.Errorf(`Invalid mod "%s": expected syntax /xml/path@attr=newValue`, mod)
+// declareNamespaces returns the namespace bindings in scope for an
+// element with the attributes, given the bindings of its parent.  The
+// parent bindings are not modified.
+func declareNamespaces(parent map[string]string, attrs []xml.Attr) map[string]string {
+	ns := parent
+	copied := false
+	for _, attr := range attrs {
+		var prefix string
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+		case attr.Name.Space == "xmlns":
+			prefix = attr.Name.Local
+		default:
+			continue
 		}
 
-		modifications[i] = modification{
-			path:      pathAttr[0],
-			attribute: pathAttr[1],
-			value:     pathAttrValue[1],
+		if !copied {
+			ns = make(map[string]string, len(parent)+1)
+			for k, v := range parent {
+				ns[k] = v
+			}
+			copied = true
 		}
+		ns[prefix] = attr.Value
 	}
+	return ns
+}
 
-	return modifications, nil
+// pop leaves the current element and returns it
+func (t *tracker) pop() element {
+	e := t.path[len(t.path)-1]
+	t.path = t.path[:len(t.path)-1]
+	t.counters = t.counters[:len(t.counters)-1]
+	return e
 }
 
-// frobnicate applies modifications to the XML input stream and
-// returns the modified XML
-func frobnicate(in io.Reader, modifications []modification) (*bytes.Buffer, error) {
-	decoder := xml.NewDecoder(bufio.NewReader(in))
+// an operation is the kind of change a modification makes to the
+// attribute
+type operation int
+
+const (
+	opSet           operation = iota // replace the value of the attribute
+	opDelete                         // remove the attribute
+	opDeleteElement                  // remove the element and its children
+	opRename                         // rename the attribute, keeping the value
+	opRenameElement                  // rename the element
+	opReplace                        // regular expression substitution on the value
+	opGet                            // print the value, see Query
+	opAppend                         // append to the value of the attribute
+	opEditComment                    // regular expression substitution on a comment
+	opInsert                         // insert value as the last child of the element
+	opRemove                         // remove occurrences of value, or subtract it, from the value of the attribute
+	opMapValues                      // replace any attribute value found in mapping
+)
+
+// A Modification is a parsed modification pattern, see
+// ParseModifications.
+type Modification struct {
+	// Pattern is the modification as given by the user
+	Pattern string
+
+	// AddMissing makes attribute value modifications add the
+	// attribute to matching elements which do not have it
+	AddMissing bool
+
+	// Template makes {attr} in set and append values refer to
+	// the value of the attribute attr of the element in the input,
+	// see expandTemplate
+	Template bool
+
+	// FailMissing makes it an error for an element matching a
+	// modification of an attribute to lack the attribute, unless
+	// it is added as with AddMissing.  Deleting a missing attribute
+	// is never an error.
+	FailMissing bool
+
+	// IgnoreCase makes element names in the path match regardless
+	// of case.  Attribute names are still compared exactly.
+	IgnoreCase bool
+
+	// Increment makes += add the value to the integer value of the
+	// attribute instead of appending it, and -= subtract it instead of
+	// removing text, see addInt.
+	Increment bool
+
+	// PadWidth, if not 0, pads the results of Increment with zeros
+	// to at least PadWidth digits.  Otherwise the results have as
+	// many digits as the old value if it starts with 0.
+	PadWidth int
+
+	// MaxMatches, if not 0, limits the modification to the first
+	// MaxMatches elements or comments it changes, in document order
+	MaxMatches int
+
+	// Type is the expected type of the value, see CheckTypes
+	Type ValueType
 
+	// Create makes set and append modifications create the
+	// missing elements of the path, and add missing attributes,
+	// see Creatable.  The new elements are added as the last
+	// children of the deepest existing element on the path.
+	Create bool
+
+	// Unique makes it an error for the modification to match more
+	// than one element or comment in the input
+	Unique bool
+
+	// CollapseSpace makes removing text from a value also remove the
+	// whitespace around it, see removeText
+	CollapseSpace bool
+
+	// AttrBefore makes attributes added by AddMissing or Create go
+	// before the attribute with this name, which may include a
+	// prefix, instead of last, if the element has it.  * puts them
+	// first.  The attributes of new elements are in the order of the
+	// predicates and modifications regardless.
+	AttrBefore string
+
+	// an element path, attribute name (empty for opDeleteElement),
+	// the operation and, for opSet, the new value for the attribute
+	// or, for opAppend, the text to append to it, or, for opRemove,
+	// the text to remove from it, or with Increment the number to
+	// subtract, or, for opRename and opRenameElement, the new name.  For
+	// opReplace, matches of re in the current value are replaced
+	// with value, which may refer to capture groups as $1, and
+	// likewise for the text of comments for opEditComment.  For
+	// opInsert, value is the XML fragment to insert.  If
+	// guard is set, only attributes with that value are modified.
+	// For opMapValues, mapping gives the new value for each old
+	// value of any attribute.  If file is set, value is @filename,
+	// see ReadValueFiles.  If attrByNamespace is set, the prefix of
+	// attribute was bound to the URI attrNamespace by BindNamespaces.
+	path            []step
+	attribute       string
+	attrNamespace   string
+	attrByNamespace bool
+	op              operation
+	value           string
+	file            bool
+	re              *regexp.Regexp
+	guard           *string
+	mapping         map[string]string
+}
+
+// IsQuery reports whether the modification is a query of the form
+// /xml/path@attr, which is used with Query rather than Frobnicate
+func (m *Modification) IsQuery() bool {
+	return m.op == opGet
+}
+
+// IsDeletion reports whether the modification deletes an attribute or
+// an element, as in /xml/path@attr! and /xml/path!
+func (m *Modification) IsDeletion() bool {
+	return m.op == opDelete || m.op == opDeleteElement
+}
+
+// targets reports whether the modification applies to the attribute,
+// by name and, if the modification is guarded, by value
+func (m *Modification) targets(a attr) bool {
+	return m.matchesAttr(a) && (m.guard == nil || a.Value == *m.guard)
+}
+
+// matchesAttr reports whether the attribute has the name of the
+// modification, by namespace URI if the prefix was bound by
+// BindNamespaces
+func (m *Modification) matchesAttr(a attr) bool {
+	return matchesAttr(a.Name, a.namespace, m.attribute, m.attrNamespace, m.attrByNamespace)
+}
+
+// newAttrName returns the name of an attribute added by the
+// modification to an element with the namespace bindings ns in scope.
+// If the prefix of the attribute was bound by BindNamespaces, the
+// element's prefix for the namespace is used instead, if it has one.
+func (m *Modification) newAttrName(ns map[string]string) xml.Name {
+	name := rename(xml.Name{}, m.attribute)
+	if !m.attrByNamespace || ns[name.Space] == m.attrNamespace {
+		return name
+	}
+	var prefixes []string
+	for prefix, uri := range ns {
+		if prefix != "" && uri == m.attrNamespace {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) > 0 {
+		sort.Strings(prefixes)
+		name.Space = prefixes[0]
+	}
+	return name
+}
+
+// expandTemplate replaces {name} in template with the value of the
+// attribute name, which may include a prefix, in attrs.  {{ and }}
+// give literal braces.  A missing attribute is an error.
+func expandTemplate(template string, attrs []xml.Attr) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(template) && template[i+1] == c:
+			b.WriteByte(c)
+			i++
+		case c == '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated { in %s", template)
+			}
+			name := template[i+1 : i+end]
+			found := false
+			for _, a := range attrs {
+				if matchesAttrName(a.Name, name) {
+					b.WriteString(a.Value)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("no attribute %s for {%s}", name, name)
+			}
+			i += end
+		case c == '}':
+			return "", fmt.Errorf("unexpected } in %s, use }} for a literal }", template)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// lacks reports whether the modification changes an attribute which
+// is missing from attrs, and will not be added
+func (m *Modification) lacks(attrs []attr) bool {
+	switch m.op {
+	case opSet, opAppend:
+		if m.AddMissing || m.Create {
+			return false
+		}
+	case opReplace, opRename, opRemove:
+	default:
+		return false
+	}
+
+	for _, a := range attrs {
+		if m.matchesAttr(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply applies the modification to the attributes of a matching
+// element, with the namespace bindings ns, and returns the new
+// attributes along with the changes made, without their Path.
+// Deleting an attribute which is not present is not an error.  Missing
+// attributes are never added by guarded modifications.
+func (m *Modification) apply(attrs []attr, ns map[string]string) ([]attr, []AppliedChange) {
+	var changes []AppliedChange
+	change := func(op string, a xml.Name, old, new string) {
+		changes = append(changes, AppliedChange{Pattern: m.Pattern, Op: op, Attr: qualifiedName(a), Old: old, New: new})
+	}
+
+	switch m.op {
+	case opDelete:
+		kept := attrs[:0]
+		for _, a := range attrs {
+			if m.targets(a) {
+				change("delete", a.Name, a.Value, "")
+			} else {
+				kept = append(kept, a)
+			}
+		}
+		return kept, changes
+	case opSet:
+		for i, a := range attrs {
+			if m.targets(a) {
+				attrs[i].Value = m.value
+				change("set", a.Name, a.Value, m.value)
+			}
+		}
+		if len(changes) == 0 && (m.AddMissing || m.Create) && m.guard == nil {
+			name := m.newAttrName(ns)
+			attrs = insertAttr(attrs, attr{Attr: xml.Attr{Name: name, Value: m.value}, namespace: attrNamespace(name, ns)}, m.AttrBefore)
+			change("add", name, "", m.value)
+		}
+	case opAppend:
+		for i, a := range attrs {
+			if m.targets(a) && m.Increment {
+				attrs[i].Value, _ = addInt(a.Value, m.value, false, m.PadWidth) // see checkInts
+				change("increment", a.Name, a.Value, attrs[i].Value)
+			} else if m.targets(a) {
+				attrs[i].Value += m.value
+				change("append", a.Name, a.Value, attrs[i].Value)
+			}
+		}
+		if len(changes) == 0 && (m.AddMissing || m.Create) && m.guard == nil {
+			value := m.value
+			if m.Increment {
+				value, _ = addInt("0", m.value, false, m.PadWidth) // see CheckIncrements
+			}
+			name := m.newAttrName(ns)
+			attrs = insertAttr(attrs, attr{Attr: xml.Attr{Name: name, Value: value}, namespace: attrNamespace(name, ns)}, m.AttrBefore)
+			change("add", name, "", value)
+		}
+	case opReplace:
+		for i, a := range attrs {
+			if m.targets(a) {
+				attrs[i].Value = m.re.ReplaceAllString(a.Value, m.value)
+				change("replace", a.Name, a.Value, attrs[i].Value)
+			}
+		}
+	case opRemove:
+		for i, a := range attrs {
+			if m.targets(a) && m.Increment {
+				attrs[i].Value, _ = addInt(a.Value, m.value, true, m.PadWidth) // see checkInts
+				change("decrement", a.Name, a.Value, attrs[i].Value)
+			} else if m.targets(a) && strings.Contains(a.Value, m.value) {
+				attrs[i].Value = removeText(a.Value, m.value, m.CollapseSpace)
+				change("remove", a.Name, a.Value, attrs[i].Value)
+			}
+		}
+	case opRename:
+		for i, a := range attrs {
+			if m.targets(a) {
+				attrs[i].Name = rename(a.Name, m.value)
+				change("rename", a.Name, qualifiedName(a.Name), qualifiedName(attrs[i].Name))
+			}
+		}
+	case opMapValues:
+		for i, a := range attrs {
+			if new, ok := m.mapping[a.Value]; ok && !isNamespaceDecl(a.Name) {
+				attrs[i].Value = new
+				change("map", a.Name, a.Value, new)
+			}
+		}
+	case opDeleteElement:
+		// applies to the element as a whole
+		change("delete-element", xml.Name{}, "", "")
+	case opRenameElement:
+		change("rename-element", xml.Name{}, "", m.value)
+	case opInsert:
+		change("insert", xml.Name{}, "", m.value)
+	}
+	return attrs, changes
+}
+
+// insertAttr inserts a new attribute before the first attribute
+// matching the name before, or first for *, or last if before is
+// empty or not present
+func insertAttr(attrs []attr, a attr, before string) []attr {
+	if before != "" {
+		for i := range attrs {
+			if before == "*" || matchesAttrName(attrs[i].Name, before) {
+				attrs = append(attrs, attr{})
+				copy(attrs[i+1:], attrs[i:])
+				attrs[i] = a
+				return attrs
+			}
+		}
+	}
+	return append(attrs, a)
+}
+
+// removeText removes every occurrence of text from value.  With
+// collapse, the whitespace around each occurrence is removed too, and
+// what remains on either side is separated by a single space if there
+// was whitespace, so removing -Xdebug from "-Xmx1g -Xdebug -Dx=1"
+// gives "-Xmx1g -Dx=1" rather than "-Xmx1g  -Dx=1".
+func removeText(value, text string, collapse bool) string {
+	parts := strings.Split(value, text)
+	if !collapse {
+		return strings.Join(parts, "")
+	}
+
+	const space = " \t\r\n"
+	result := parts[0]
+	for _, part := range parts[1:] {
+		before := strings.TrimRight(result, space)
+		after := strings.TrimLeft(part, space)
+		spaced := len(before) != len(result) || len(after) != len(part)
+		result = before
+		if spaced && before != "" && after != "" {
+			result += " "
+		}
+		result += after
+	}
+	return result
+}
+
+// matchesName reports whether a raw element name matches the name from
+// a pattern.  The prefix is only compared if the pattern includes one,
+// as in prefix:name.
+func matchesName(raw xml.Name, name string) bool {
+	return matchesElementName(raw, name, false)
+}
+
+// matchesAttrName reports whether a raw attribute name matches the name
+// from a pattern.  Unlike for elements, the prefix is always compared,
+// as an attribute without a prefix is in no namespace, so type does not
+// match xsi:type.
+func matchesAttrName(raw xml.Name, name string) bool {
+	return qualifiedName(raw) == name
+}
+
+// matchesAttr is like matchesAttrName, but if byNamespace is set, the
+// prefix of name was bound to the URI uri by BindNamespaces, and it
+// matches attributes in that namespace, given as rawNS, with any
+// prefix
+func matchesAttr(raw xml.Name, rawNS, name, uri string, byNamespace bool) bool {
+	if !byNamespace {
+		return matchesAttrName(raw, name)
+	}
+	_, local, _ := strings.Cut(name, ":")
+	return raw.Space != "" && rawNS == uri && raw.Local == local
+}
+
+// xmlNamespace is the namespace URI bound to the xml prefix
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// attrNamespace returns the namespace URI of the raw attribute name,
+// given the namespace bindings ns in scope, or "" if it has no prefix
+// or the prefix is not declared
+func attrNamespace(name xml.Name, ns map[string]string) string {
+	switch name.Space {
+	case "":
+		return ""
+	case "xml":
+		return xmlNamespace
+	}
+	return ns[name.Space]
+}
+
+// checkInts returns an error if an Increment modification cannot be
+// applied to an attribute in attrs, as its value is not an integer or
+// the result would overflow
+func (m *Modification) checkInts(attrs []attr) error {
+	if !m.Increment || (m.op != opAppend && m.op != opRemove) {
+		return nil
+	}
+	for _, a := range attrs {
+		if m.targets(a) {
+			if _, err := addInt(a.Value, m.value, m.op == opRemove, m.PadWidth); err != nil {
+				return fmt.Errorf("attribute %s: %v", qualifiedName(a.Name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRename returns an error if a rename modification would give an
+// attribute in attrs the name of another attribute of the element
+func (m *Modification) checkRename(attrs []attr) error {
+	if m.op != opRename {
+		return nil
+	}
+	for _, a := range attrs {
+		if !m.targets(a) {
+			continue
+		}
+		name := rename(a.Name, m.value)
+		for _, b := range attrs {
+			if b.Name == name && b.Name != a.Name {
+				return fmt.Errorf("cannot rename attribute %s to %s, which already exists", qualifiedName(a.Name), qualifiedName(name))
+			}
+		}
+	}
+	return nil
+}
+
+// addInt returns the decimal integer value plus delta, or minus delta
+// if subtract is set, padded with zeros to width digits.  If width is
+// 0, the zero padding of value is kept instead, so 007 plus 1 is 008.
+func addInt(value, delta string, subtract bool, width int) (string, error) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf(`value "%s" is not an integer`, value)
+	}
+	d, err := strconv.ParseInt(delta, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf(`"%s" is not an integer`, delta)
+	}
+	if subtract {
+		d = -d
+	}
+	sum := v + d
+	if (d > 0 && sum < v) || (d < 0 && sum > v) {
+		return "", fmt.Errorf(`value "%s" is too large to change by %d`, value, d)
+	}
+
+	if width == 0 {
+		if digits := strings.TrimLeft(value, "+-"); len(digits) > 1 && digits[0] == '0' {
+			width = len(digits)
+		}
+	}
+	result := strconv.FormatInt(sum, 10)
+	digits := strings.TrimPrefix(result, "-")
+	if len(digits) < width {
+		result = result[:len(result)-len(digits)] + strings.Repeat("0", width-len(digits)) + digits
+	}
+	return result, nil
+}
+
+// rename returns the raw element or attribute name renamed to name.
+// The original prefix is kept unless name includes a prefix.
+func rename(orig xml.Name, name string) xml.Name {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return xml.Name{Space: name[:i], Local: name[i+1:]}
+	}
+	return xml.Name{Space: orig.Space, Local: name}
+}
+
+// withinLimit returns the modifications which have changed fewer
+// elements than their MaxMatches, given the number of elements changed
+// by each modification so far
+func withinLimit(modifications []*Modification, changed map[*Modification]int) []*Modification {
+	result := modifications[:0]
+	for _, m := range modifications {
+		if m.MaxMatches == 0 || changed[m] < m.MaxMatches {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// renamesElement returns the new name of the element, or "" if none
+// of the modifications renames it.  The last rename wins.
+func renamesElement(modifications []*Modification) string {
+	var name string
+	for _, m := range modifications {
+		if m.op == opRenameElement {
+			name = m.value
+		}
+	}
+	return name
+}
+
+// deletesElement reports whether any of the modifications deletes the
+// element
+func deletesElement(modifications []*Modification) bool {
+	for _, m := range modifications {
+		if m.op == opDeleteElement {
+			return true
+		}
+	}
+	return false
+}
+
+// trimTagEnd drops the whitespace before the final > of the start tag
+// at the end of buf, which was written before the /> of a self-closing
+// tag such as <foo />
+func trimTagEnd(buf *bytes.Buffer) {
+	if !bytes.HasSuffix(buf.Bytes(), []byte(">")) {
+		return
+	}
+	tag := bytes.TrimRight(buf.Bytes()[:buf.Len()-1], " \t\r\n")
+	buf.Truncate(len(tag))
+	buf.WriteByte('>')
+}
+
+// endTagSpace returns the whitespace before the > of the raw end tag,
+// as in </foo >, to write it as in the input
+func endTagSpace(raw []byte) []byte {
+	if !bytes.HasSuffix(raw, []byte(">")) {
+		return nil
+	}
+	tag := bytes.TrimRight(raw[:len(raw)-1], " \t\r\n")
+	return raw[len(tag) : len(raw)-1]
+}
+
+// conflicting returns the first two of the modifications matching an
+// element which contradict each other, so the result would depend on
+// their order: setting the same attribute to different values, setting
+// and deleting it, or renaming the element to different names.
+// Modifications with different guards do not conflict, as they apply
+// to different values.
+func conflicting(modifications []*Modification) (*Modification, *Modification) {
+	for i, a := range modifications {
+		for _, b := range modifications[i+1:] {
+			if a.conflicts(b) {
+				return a, b
+			}
+		}
+	}
+	return nil, nil
+}
+
+// conflicts reports whether m and other conflict, see conflicting
+func (m *Modification) conflicts(other *Modification) bool {
+	if m.op == opRenameElement && other.op == opRenameElement {
+		return m.value != other.value
+	}
+	changes := func(op operation) bool {
+		return op == opSet || op == opDelete
+	}
+	if !changes(m.op) || !changes(other.op) || m.attribute != other.attribute {
+		return false
+	}
+	if (m.guard == nil) != (other.guard == nil) || (m.guard != nil && *m.guard != *other.guard) {
+		return false
+	}
+	return m.op != other.op || m.value != other.value
+}
+
+// Options controls the output of FrobnicateWithOptions.  The zero
+// value keeps the style of the input.
+type Options struct {
+	// Quote selects the quote character around attribute values
+	Quote Quote
+
+	// EOL selects the line endings of the output
+	EOL EOL
+
+	// Indent, if set, reindents the whole document with Indent for
+	// each level, see reindent, instead of keeping the layout of
+	// the input
+	Indent string
+
+	// Minify removes whitespace between tags, see minify.  It
+	// cannot be combined with Indent.
+	Minify bool
+
+	// Empty selects how elements without content are written
+	Empty Empty
+
+	// SortAttrs sorts the attributes of each element, see sortAttrs
+	SortAttrs bool
+
+	// OnlyMatches only writes the elements matching any of the
+	// modifications, with their children, each followed by a
+	// newline, instead of the whole document
+	OnlyMatches bool
+
+	// StripBOM removes a UTF-8 byte order mark at the start of
+	// the input, which is kept otherwise
+	StripBOM bool
+
+	// Annotate writes a comment before each element whose start tag
+	// is changed, describing the changes with the old values, see
+	// annotation
+	Annotate bool
+
+	// AllowConflicts applies modifications which conflict on an
+	// element in order, the last one winning, instead of failing,
+	// see conflicting
+	AllowConflicts bool
+
+	// OnChange, if set, is called for each change made, in
+	// document order
+	OnChange func(AppliedChange)
+
+	// OnElement, if set, is called for each element before any
+	// changes to it, with its path as in AppliedChange and the
+	// patterns of the modifications matching it.  It is not called
+	// for the children of deleted elements.
+	OnElement func(path string, patterns []string)
+
+	// utf8Output writes UTF-8 regardless of the encoding of the
+	// input, for reformatting the output before encoding it
+	utf8Output bool
+}
+
+// An AppliedChange describes a single change made by a modification.
+// Op is one of set, add, append, increment, remove, decrement, replace,
+// map, delete, rename, delete-element, rename-element, insert, create
+// and comment.  For create, Path is that of the new element with the
+// attribute.  For changes to the element as a whole, Attr is empty, and
+// for renames Old and New are the names rather than values.
+type AppliedChange struct {
+	Pattern string // the modification, see Modification.Pattern
+	Op      string
+	Path    string // the element, with its position, as in /a[1]/b[2]
+	Attr    string
+	Old     string
+	New     string
+}
+
+// Frobnicate applies modifications to the XML read from in, and writes
+// the modified XML to out.  Queries are ignored.
+func Frobnicate(in io.Reader, out io.Writer, modifications []Modification) error {
+	_, err := FrobnicateWithOptions(in, out, modifications, nil)
+	return err
+}
+
+// FrobnicateWithOptions is like Frobnicate, but formats the output
+// according to opts, which may be nil for the defaults.  It returns
+// the number of times each modification was applied.  Nothing is
+// written to out if the input is not valid XML.
+func FrobnicateWithOptions(in io.Reader, out io.Writer, modifications []Modification, opts *Options) ([]int, error) {
+	var buf bytes.Buffer
+	counts, err := frobnicate(in, &buf, modifications, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := buf.WriteTo(out); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// FrobnicateChanges is like FrobnicateWithOptions, but returns the
+// changes made, in document order, instead of the number of times each
+// modification was applied.  opts.OnChange, if set, is still called
+// for each change.
+func FrobnicateChanges(in io.Reader, out io.Writer, modifications []Modification, opts *Options) ([]AppliedChange, error) {
+	var changes []AppliedChange
+	collect := Options{}
+	if opts != nil {
+		collect = *opts
+	}
+	collect.OnChange = func(c AppliedChange) {
+		changes = append(changes, c)
+		if opts != nil && opts.OnChange != nil {
+			opts.OnChange(c)
+		}
+	}
+
+	if _, err := FrobnicateWithOptions(in, out, modifications, &collect); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// FrobnicateStream is like FrobnicateWithOptions, but writes the
+// output to out as the input is read, instead of keeping it all in
+// memory until the end.  If the input turns out to be invalid, the
+// output written so far is incomplete.
+func FrobnicateStream(in io.Reader, out io.Writer, modifications []Modification, opts *Options) ([]int, error) {
+	return frobnicate(in, out, modifications, opts)
+}
+
+// FrobnicateBuffer is like Frobnicate, but returns the modified XML in
+// a buffer
+func FrobnicateBuffer(in io.Reader, modifications []Modification) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if _, err := frobnicate(in, &buf, modifications, nil); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// frobnicate applies modifications to the XML input stream, writes
+// the modified XML to w and returns the number of times each
+// modification was applied.  Input without any elements, such as an
+// empty file or only whitespace and comments, is written unchanged.
+func frobnicate(in io.Reader, w io.Writer, modifications []Modification, opts *Options) ([]int, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Indent != "" || opts.Minify {
+		return frobnicateReformatted(in, w, modifications, opts)
+	}
+
+	br := bufio.NewReader(in)
+	bom, err := skipBOM(br)
+	if err != nil {
+		return nil, err
+	}
+	if bom && !opts.StripBOM && !opts.OnlyMatches {
+		if _, err := w.Write(utf8BOM); err != nil {
+			return nil, err
+		}
+	}
+
+	if ew := newEOLWriter(w, opts.EOL); ew != nil {
+		w = ew
+	}
+
+	br, cs, err := decodeInput(br)
+	if err != nil {
+		return nil, err
+	}
+	if cs != nil && !opts.utf8Output {
+		w = &charsetWriter{w: w, cs: cs}
+	}
+
+	var t tracker
+	br, t.contents, err = lookahead(br, modifications)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recorder{r: br}
+	decoder := newDecoder(rec)
+
+	// the line ending of the input, for new lines in the output
+	eol := "\n"
+	eolKnown := false
+
+	// the output is written to w token by token, except that the
+	// last start tag is held back in outbytes until it is known
+	// whether the element is empty and should be self-closing
 	var outbytes bytes.Buffer
 	out := xml.NewEncoder(&outbytes)
+
+	// with opts.OnlyMatches, matchDepth is the depth of the matched
+	// element being written, and output outside of it is dropped
+	var matchDepth int
+	emit := func() error {
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if opts.OnlyMatches && matchDepth == 0 {
+			outbytes.Reset()
+			return nil
+		}
+		_, err := outbytes.WriteTo(w)
+		return err
+	}
 	var previousWasStart bool
-	var path bytes.Buffer
+	hits := make(map[*Modification]int)
+	changedElements := make(map[*Modification]int)
+	matches := make(map[*Modification]int)
+	countMatches := func(matched []*Modification) {
+		for _, m := range matched {
+			matches[m]++
+		}
+	}
+	var creators []*Modification
+	for i := range modifications {
+		if modifications[i].Create && modifications[i].Creatable() {
+			creators = append(creators, &modifications[i])
+		}
+	}
+
+	record := func(m *Modification, path []element, changes []AppliedChange) {
+		hits[m] += len(changes)
+		if len(changes) > 0 {
+			changedElements[m]++
+		}
+		if opts.OnChange == nil {
+			return
+		}
+		p := elementPath(path)
+		for _, c := range changes {
+			c.Path = p
+			opts.OnChange(c)
+		}
+	}
+
+	// the quote character last seen in the input, used for new
+	// attributes on elements without other attributes
+	docQuote := byte('"')
+
+	// skipDepth is the number of open elements inside a deleted
+	// element, including itself
+	var skipDepth int
+
+	// whitespace is held back until the next token, so the
+	// indentation before a deleted element can be dropped with it.
+	// dropped is the line break and indentation dropped before the
+	// last deleted element, for a comment or element following it
+	// on the same line.
+	var pending []byte
+	var dropped []byte
+	flushPending := func() error {
+		if pending == nil {
+			return nil
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		outbytes.Write(pending)
+		pending = nil
+		return nil
+	}
+
 	for {
+		if !previousWasStart {
+			if err := emit(); err != nil {
+				return nil, err
+			}
+		}
+
 		tok, err := decoder.RawToken()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			log.Fatalf("Unexpected error while parsing XML file: %v", err)
+			return nil, fmt.Errorf("Unexpected error while parsing XML file: %v", err)
+		}
+		raw := rec.raw(decoder.InputOffset())
+		if !eolKnown {
+			if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+				eolKnown = true
+				if i > 0 && raw[i-1] == '\r' {
+					eol = "\r\n"
+				}
+			}
 		}
+
+		if skipDepth > 0 {
+			switch tok.(type) {
+			case xml.StartElement:
+				t.skip()
+				skipDepth++
+			case xml.EndElement:
+				skipDepth--
+			}
+			continue
+		}
+
+		if text, ok := tok.(xml.CharData); ok && len(bytes.TrimSpace(text)) == 0 && !bytes.HasPrefix(raw, cdataStart) {
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+			pending = append([]byte{}, raw...)
+			if bytes.IndexByte(raw, '\n') >= 0 {
+				dropped = nil
+			}
+			previousWasStart = false
+			continue
+		}
+
+		if dropped != nil {
+			switch tok.(type) {
+			case xml.StartElement, xml.Comment, xml.ProcInst:
+				// start the line of the deleted element with
+				// what followed it, instead of moving that to
+				// the end of the previous line
+				pending = dropped
+			}
+			dropped = nil
+		}
+
 		switch tok := tok.(type) {
 		case xml.StartElement:
-			path.WriteByte('/')
-			path.WriteString(tok.Name.Local)
-
-			for _, pat := range modifications {
-				if path.String() == pat.path {
-					for i, attr := range tok.Attr {
-						if attr.Name.Local == pat.attribute {
-							tok.Attr[i].Value = pat.value
-						}
+			t.push(tok)
+
+			matched := matching(modifications, t.path)
+			countMatches(matched)
+			matched = withinLimit(matched, changedElements)
+			if !opts.AllowConflicts {
+				if a, b := conflicting(matched); a != nil {
+					return nil, fmt.Errorf(`Mods "%s" and "%s" conflict on element %s, use only one of them`, a.Pattern, b.Pattern, elementPath(t.path))
+				}
+			}
+			if opts.OnElement != nil {
+				patterns := make([]string, len(matched))
+				for i, pat := range matched {
+					patterns[i] = pat.Pattern
+				}
+				opts.OnElement(elementPath(t.path), patterns)
+			}
+
+			if deletesElement(matched) {
+				for _, pat := range matched {
+					if pat.op == opDeleteElement {
+						_, changes := pat.apply(nil, nil)
+						record(pat, t.path, changes)
 					}
 				}
+				t.pop()
+				if bytes.IndexByte(pending, '\n') >= 0 {
+					dropped = pending
+				}
+				pending = nil
+				skipDepth = 1
+				continue
 			}
 
-			previousWasStart = true
-			if err := out.EncodeToken(tok); err != nil {
+			ns := t.path[len(t.path)-1].ns
+			attrs, tail := tagAttrs(tok, raw)
+			for i := range attrs {
+				attrs[i].namespace = attrNamespace(attrs[i].Name, ns)
+			}
+			if len(attrs) > 0 && attrs[0].quote != 0 {
+				docQuote = attrs[0].quote
+			}
+
+			var annotated []AppliedChange
+			for _, pat := range matched {
+				if pat.FailMissing && pat.lacks(attrs) {
+					return nil, fmt.Errorf(`Mod "%s": element %s has no attribute %s`, pat.Pattern, elementPath(t.path), pat.attribute)
+				}
+				if err := pat.checkInts(attrs); err != nil {
+					return nil, fmt.Errorf(`Mod "%s": element %s: %v`, pat.Pattern, elementPath(t.path), err)
+				}
+				if err := pat.checkRename(attrs); err != nil {
+					return nil, fmt.Errorf(`Mod "%s": element %s: %v`, pat.Pattern, elementPath(t.path), err)
+				}
+
+				applied := pat
+				if pat.Template && (pat.op == opSet || pat.op == opAppend) {
+					value, err := expandTemplate(pat.value, tok.Attr)
+					if err != nil {
+						return nil, fmt.Errorf(`Mod "%s": element %s: %v`, pat.Pattern, elementPath(t.path), err)
+					}
+					expanded := *pat
+					expanded.value = value
+					applied = &expanded
+				}
+
+				var changes []AppliedChange
+				attrs, changes = applied.apply(attrs, ns)
+				for i := range changes {
+					if changes[i].Op == "rename-element" {
+						changes[i].Old = qualifiedName(tok.Name)
+					}
+				}
+				record(pat, t.path, changes)
+				if opts.Annotate {
+					annotated = append(annotated, changes...)
+				}
+			}
+
+			e := &t.path[len(t.path)-1]
+			if name := renamesElement(matched); name != "" {
+				tok.Name = rename(tok.Name, name)
+				e.outName = &tok.Name
+			}
+			for _, pat := range matched {
+				if pat.op == opInsert {
+					e.inserts = append(e.inserts, pat.value)
+				}
+			}
+			e.creates = creating(creators, t.path, matches)
+
+			e.indent = lineIndent(pending)
+			if len(t.path) > 1 && e.indent != "" {
+				t.path[len(t.path)-2].childIndent = e.indent
+			}
+
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+			if err := out.Flush(); err != nil {
 				return nil, err
 			}
 
-		case xml.EndElement:
-			path.Truncate(bytes.LastIndexByte(path.Bytes(), '/'))
+			if opts.SortAttrs {
+				sortAttrs(attrs)
+			}
 
-			if previousWasStart {
-				// hack: Replace <foo></foo> with self-closing tags <foo/>
-				// https://groups.google.com/forum/#!topic/golang-nuts/guG6iOCRu08
-				if err := out.Flush(); err != nil {
-					return nil, err
+			if opts.OnlyMatches && matchDepth == 0 && len(matched) > 0 {
+				outbytes.Reset()
+				matchDepth = len(t.path)
+			}
+
+			if text := annotation(annotated); text != "" {
+				// on a line of its own before the element, if
+				// the element starts a line
+				outbytes.WriteString("<!-- " + text + " -->")
+				switch {
+				case opts.OnlyMatches && matchDepth == len(t.path):
+					// the indentation before the match is dropped
+					outbytes.WriteString(eol)
+				case e.indent != "":
+					outbytes.WriteString(e.indent)
+				case len(t.path) == 1:
+					outbytes.WriteString(eol)
 				}
+			}
+
+			previousWasStart = true
+			writeStartTag(&outbytes, tok.Name, attrs, tail, opts.Quote, docQuote)
+
+		case xml.EndElement:
+			if len(t.path) == 0 {
+				return nil, fmt.Errorf("Unexpected end tag </%s> without start tag", qualifiedName(tok.Name))
+			}
+			children := t.counters[len(t.counters)-1]
+			e := t.pop()
+			if e.qname != tok.Name {
+				return nil, fmt.Errorf("Unexpected end tag </%s>, expected </%s>", qualifiedName(tok.Name), qualifiedName(e.qname))
+			}
+			if e.outName != nil {
+				tok.Name = *e.outName
+			}
 
-				if outbytes.Bytes()[outbytes.Len()-1] != '>' {
-					panic("expected > token as last byte in output")
+			if groups := groupCreations(e, len(t.path)+1, matches); len(groups) > 0 {
+				var parentIndent string
+				if len(t.path) > 0 {
+					parentIndent = t.path[len(t.path)-1].indent
+				}
+				childIndent, _ := insertIndent(e, parentIndent, len(t.path) == 0, previousWasStart, pending, eol)
+				unit := ""
+				if childIndent != "" {
+					unit = indentUnit(e, childIndent)
+				}
+				quote := docQuote
+				switch opts.Quote {
+				case QuoteDouble:
+					quote = '"'
+				case QuoteSingle:
+					quote = '\''
 				}
-				pos := outbytes.Len() - 1
 
-				// Encode end element so the encoder is not confused..
-				if err := out.EncodeToken(tok); err != nil {
-					return nil, err
+				parents := append(t.path[:len(t.path):len(t.path)], e)
+				for _, g := range groups {
+					var fragment bytes.Buffer
+					g.write(&fragment, childIndent, unit, quote)
+					e.inserts = append(e.inserts, fragment.String())
+
+					path := g.path(parents, children)
+					for _, m := range g.mods {
+						matches[m]++
+						record(m, path, []AppliedChange{{Pattern: m.Pattern, Op: "create", Attr: m.attribute, New: m.value}})
+					}
 				}
+			}
 
+			if len(e.inserts) > 0 {
 				if err := out.Flush(); err != nil {
 					return nil, err
 				}
 
-				// Back track to before end element and final >
-				outbytes.Truncate(pos)
+				var parentIndent string
+				if len(t.path) > 0 {
+					parentIndent = t.path[len(t.path)-1].indent
+				}
+				childIndent, closing := insertIndent(e, parentIndent, len(t.path) == 0, previousWasStart, pending, eol)
+				if previousWasStart && len(raw) == 0 {
+					// expanding <foo /> for the children
+					trimTagEnd(&outbytes)
+				}
+				for _, fragment := range e.inserts {
+					outbytes.WriteString(childIndent)
+					outbytes.WriteString(fragment)
+				}
+				if pending == nil {
+					pending = []byte(closing)
+				}
+				previousWasStart = false
+			}
+
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+			if err := out.Flush(); err != nil {
+				return nil, err
+			}
+
+			// hack: Replace <foo></foo> with self-closing tags
+			// <foo/>, if the start tag is still the last output.
+			// Otherwise the end tag is written as usual.  The end
+			// of a self-closing tag in the input has no raw bytes.
+			selfClosing := opts.Empty == EmptyCollapse || (opts.Empty == EmptyPreserve && len(raw) == 0)
+			if previousWasStart && selfClosing && bytes.HasSuffix(outbytes.Bytes(), []byte(">")) {
+				// Back track to before the final > of the start tag
+				outbytes.Truncate(outbytes.Len() - 1)
 				outbytes.WriteString("/>")
 			} else {
-				if err := out.EncodeToken(tok); err != nil {
+				if previousWasStart && len(raw) == 0 {
+					// expanding <foo /> to <foo></foo>
+					trimTagEnd(&outbytes)
+				}
+				outbytes.WriteString("</")
+				outbytes.WriteString(qualifiedName(tok.Name))
+				outbytes.Write(endTagSpace(raw))
+				outbytes.WriteByte('>')
+			}
+			previousWasStart = false
+
+			if matchDepth != 0 && len(t.path) < matchDepth {
+				// end of a matched element for opts.OnlyMatches
+				outbytes.WriteString(eol)
+				if err := emit(); err != nil {
 					return nil, err
 				}
+				matchDepth = 0
+			}
+
+		case xml.CharData:
+			// text is copied as written, so CDATA sections and
+			// entity references are kept.  RawToken returns CDATA
+			// as plain text, which the encoder would escape.
+			previousWasStart = false
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+			if err := out.Flush(); err != nil {
+				return nil, err
+			}
+			outbytes.Write(raw)
+
+		case xml.Directive:
+			previousWasStart = false
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+
+			// entities declared in the internal subset of the
+			// DOCTYPE would otherwise be decoding errors
+			for name, value := range doctypeEntities(tok) {
+				if decoder.Entity == nil {
+					decoder.Entity = make(map[string]string)
+				}
+				decoder.Entity[name] = value
+			}
+
+			if err := out.Flush(); err != nil {
+				return nil, err
 			}
+			outbytes.Write(raw)
+
+		case xml.Comment:
 			previousWasStart = false
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+
+			text := string(tok)
+			edited := false
+			commentPath := append(t.path[:len(t.path):len(t.path)], element{comment: true})
+			commentMatched := matching(modifications, commentPath)
+			countMatches(commentMatched)
+			for _, pat := range withinLimit(commentMatched, changedElements) {
+				if pat.op == opEditComment && pat.re.MatchString(text) {
+					old := text
+					text = pat.re.ReplaceAllString(text, pat.value)
+					edited = true
+					record(pat, commentPath, []AppliedChange{{Pattern: pat.Pattern, Op: "comment", Old: old, New: text}})
+				}
+			}
+
+			if err := out.Flush(); err != nil {
+				return nil, err
+			}
+			if !edited {
+				outbytes.Write(raw)
+				break
+			}
+			if strings.Contains(text, "--") || strings.HasSuffix(text, "-") {
+				return nil, fmt.Errorf("Invalid comment after modification, contains -- or ends with -: %s", text)
+			}
+			outbytes.WriteString("<!--")
+			outbytes.WriteString(text)
+			outbytes.WriteString("-->")
+
+		case xml.ProcInst:
+			previousWasStart = false
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
+
+			// keep the declaration and other processing
+			// instructions such as xml-stylesheet exactly as
+			// written, the encoder would normalize their spacing
+			if err := out.Flush(); err != nil {
+				return nil, err
+			}
+			outbytes.Write(raw)
 
 		default:
 			previousWasStart = false
+			if err := flushPending(); err != nil {
+				return nil, err
+			}
 			if err := out.EncodeToken(tok); err != nil {
 				return nil, err
 			}
 		}
 	}
 
-	return &outbytes, out.Flush()
+	if len(t.path) != 0 {
+		return nil, fmt.Errorf("Unexpected end of file, missing end tag </%s>", qualifiedName(t.path[len(t.path)-1].qname))
+	}
+
+	var ambiguous []string
+	for i := range modifications {
+		m := &modifications[i]
+		if m.Unique && matches[m] > 1 {
+			ambiguous = append(ambiguous, fmt.Sprintf(`Mod "%s" matched %d elements`, m.Pattern, matches[m]))
+		}
+	}
+	if len(ambiguous) > 0 {
+		return nil, fmt.Errorf("%s, expected at most one", strings.Join(ambiguous, ", "))
+	}
+
+	counts := make([]int, len(modifications))
+	for i := range modifications {
+		counts[i] = hits[&modifications[i]]
+	}
+
+	if err := flushPending(); err != nil {
+		return nil, err
+	}
+	if err := emit(); err != nil {
+		return nil, err
+	}
+	if ew, ok := w.(*eolWriter); ok {
+		if err := ew.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
 }
 
-func usage(message string) {
-	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS...] <PATTERNS...>\n\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "Pattern syntax: /xml/patt@attr=val\n\n")
-	if message != "" {
-		fmt.Fprintf(os.Stderr, "%v\n", message)
+// frobnicateReformatted is frobnicate for opts.Indent and
+// opts.Minify.  The document is modified in memory first, keeping the
+// layout, and then reformatted.
+func frobnicateReformatted(in io.Reader, w io.Writer, modifications []Modification, opts *Options) ([]int, error) {
+	if opts.Indent != "" && opts.Minify {
+		return nil, fmt.Errorf("cannot both indent and minify the output")
+	}
+
+	plain := *opts
+	plain.Indent, plain.Minify, plain.EOL = "", false, EOLPreserve
+	plain.utf8Output = true
+
+	var buf bytes.Buffer
+	counts, err := frobnicate(in, &buf, modifications, &plain)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, err := lookupCharset(declaredEncoding(bufio.NewReader(bytes.NewReader(bytes.TrimPrefix(buf.Bytes(), utf8BOM)))))
+	if err != nil {
+		return nil, err
+	}
+	if cs != nil {
+		w = &charsetWriter{w: w, cs: cs}
+	}
+
+	eol := "\n"
+	if ew := newEOLWriter(w, opts.EOL); ew != nil {
+		w = ew
+	} else if i := bytes.IndexByte(buf.Bytes(), '\n'); i > 0 && buf.Bytes()[i-1] == '\r' {
+		eol = "\r\n"
+	}
+
+	if opts.Minify {
+		err = minify(buf.Bytes(), w)
 	} else {
-		flag.PrintDefaults()
+		err = reindent(buf.Bytes(), w, opts.Indent, eol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ew, ok := w.(*eolWriter); ok {
+		if err := ew.flush(); err != nil {
+			return nil, err
+		}
 	}
-	os.Exit(1)
+	return counts, nil
 }
 
-func main() {
-	var (
-		input   string
-		inplace bool
-	)
+// elementPath returns the path of the last element in path, with the
+// position of each element among its siblings of the same name, or
+// comment() for comments
+func elementPath(path []element) string {
+	var b strings.Builder
+	for _, e := range path {
+		b.WriteByte('/')
+		if e.comment {
+			b.WriteString("comment()")
+			break
+		}
+		fmt.Fprintf(&b, "%s[%d]", escapeName(qualifiedName(e.qname)), e.position)
+	}
+	return b.String()
+}
 
-	flag.Usage = func() { usage("") }
-	flag.StringVar(&input, "input", "-", "input XML file (default to stdin)")
-	flag.BoolVar(&inplace, "inplace", false, "modify in place (save back to same file as input)")
+// annotation describes the changes made to the start tag of an
+// element for Options.Annotate, as in "xmlfrob: port 8080->8181", or
+// returns "" if nothing changed.  Values are shortened with ... at 40
+// bytes, and -- is broken up as it may not occur in comments.
+func annotation(changes []AppliedChange) string {
+	short := func(value string) string {
+		if len(value) > 40 {
+			i := 37
+			for i > 0 && !utf8.RuneStart(value[i]) {
+				i--
+			}
+			value = value[:i] + "..."
+		}
+		return value
+	}
 
-	flag.Parse()
+	var parts []string
+	for _, c := range changes {
+		switch c.Op {
+		case "add":
+			parts = append(parts, fmt.Sprintf("%s added", c.Attr))
+		case "delete":
+			parts = append(parts, fmt.Sprintf("%s deleted (was %s)", c.Attr, short(c.Old)))
+		case "rename":
+			parts = append(parts, fmt.Sprintf("%s renamed to %s", c.Old, c.New))
+		case "rename-element":
+			if c.Old != c.New {
+				parts = append(parts, fmt.Sprintf("renamed from %s", c.Old))
+			}
+		default:
+			if c.Old != c.New {
+				parts = append(parts, fmt.Sprintf("%s %s->%s", c.Attr, short(c.Old), short(c.New)))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
 
-	if flag.NArg() == 0 {
-		usage("At least one modification pattern required") // exits
+	text := "xmlfrob: " + strings.Join(parts, ", ")
+	for strings.Contains(text, "--") {
+		text = strings.ReplaceAll(text, "--", "- -")
 	}
+	return text
+}
 
-	if inplace && input == "-" {
-		fmt.Fprintf(os.Stderr, "Invalid arguments: cannot combine --inplace and --input - (stdin)\n")
-		os.Exit(1)
+// lineIndent returns the indentation of the last line of whitespace,
+// including the newline (\n or \r\n), or "" if it does not contain a
+// newline
+func lineIndent(whitespace []byte) string {
+	i := bytes.LastIndexByte(whitespace, '\n')
+	if i < 0 {
+		return ""
+	}
+	if i > 0 && whitespace[i-1] == '\r' {
+		i--
 	}
+	return string(whitespace[i:])
+}
 
-	modifications, err := parseModifications(flag.Args())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+// insertIndent returns the whitespace to write before each fragment
+// inserted as the last children of e, and the whitespace to write
+// before the end tag if there is none before it in the input.  The
+// indentation of existing children is used if possible, or else one
+// level more than the end tag, guessing the level from the indentation
+// of e relative to its parent.  empty is set if e has no content,
+// while closing is the whitespace before the end tag.  New lines are
+// started with eol.
+func insertIndent(e element, parentIndent string, isRoot, empty bool, closing []byte, eol string) (string, string) {
+	if e.childIndent != "" {
+		return e.childIndent, ""
 	}
 
-	var in io.Reader
-	if input == "-" {
-		in = os.Stdin
-	} else {
-		var f *os.File
-		f, err = os.Open(input)
-		if err != nil {
-			log.Fatal(err)
+	indent := e.indent
+	if closing != nil {
+		indent = lineIndent(closing)
+	} else if !empty {
+		// text content
+		return "", ""
+	}
+
+	if indent == "" {
+		if !isRoot {
+			return "", ""
 		}
-		in = f
-		defer func() {
-			logInformationalError(f.Close())
-		}()
+		indent = eol
 	}
 
-	outbuf, err := frobnicate(in, modifications)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+	unit := "  "
+	base := parentIndent
+	if base == "" {
+		base = eol
+	}
+	if len(e.indent) > len(base) && strings.HasPrefix(e.indent, base) {
+		unit = e.indent[len(base):]
 	}
+	return indent + unit, indent
+}
 
-	if inplace {
-		err = writeInplace(input, outbuf)
-	} else {
-		_, err = io.Copy(os.Stdout, outbuf)
+// Query writes the values of the attributes matching the queries to
+// w, one per line in document order, and returns the number of values
+// found.  Modifications which are not queries are ignored.
+func Query(in io.Reader, queries []Modification, w io.Writer) (int, error) {
+	return QuerySeparated(in, queries, w, '\n')
+}
+
+// QuerySeparated is like Query, but ends each value with sep instead
+// of a newline, such as 0 for values which may contain newlines
+func QuerySeparated(in io.Reader, queries []Modification, w io.Writer, sep byte) (int, error) {
+	r, _, err := decodeInput(bufio.NewReader(in))
+	if err != nil {
+		return 0, err
 	}
 
+	var t tracker
+	r, t.contents, err = lookahead(r, queries)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not write: %v\n", err)
-		os.Exit(1)
+		return 0, err
+	}
+	decoder := newDecoder(r)
+
+	var found int
+	for {
+		tok, err := decoder.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				return found, nil
+			}
+			return found, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			t.push(tok)
+			for _, q := range matching(queries, t.path) {
+				if !q.IsQuery() {
+					continue
+				}
+				ns := t.path[len(t.path)-1].ns
+				for _, attr := range tok.Attr {
+					if matchesAttr(attr.Name, attrNamespace(attr.Name, ns), q.attribute, q.attrNamespace, q.attrByNamespace) {
+						if _, err := fmt.Fprintf(w, "%s%c", attr.Value, sep); err != nil {
+							return found, err
+						}
+						found++
+					}
+				}
+			}
+
+		case xml.EndElement:
+			if len(t.path) == 0 {
+				return found, fmt.Errorf("Unexpected end tag </%s> without start tag", qualifiedName(tok.Name))
+			}
+			t.pop()
+		}
 	}
 }
 
-// writeInplace attempts to write replace the original file with new
-// contents atomically, by writing to a temporary file and overwriting
-// the original file using rename
-func writeInplace(filename string, contents io.Reader) error {
-	tempname := filename + ".tmp"
-	output, err := os.Create(tempname)
+// Validate returns an error if the XML read from r is not well-formed,
+// including the line number of the problem.  Entities declared in the
+// internal subset of the DOCTYPE are accepted as by Frobnicate.  Unlike
+// encoding/xml, Validate also rejects start tags with two attributes
+// of the same name.
+func Validate(r io.Reader) error {
+	br, _, err := decodeInput(bufio.NewReader(r))
 	if err != nil {
 		return err
 	}
+	rec := &recorder{r: br}
+	decoder := newDecoder(rec)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		raw := rec.raw(decoder.InputOffset())
 
-	_, err = io.Copy(output, contents)
-	if err == nil {
-		err = output.Sync()
-	}
-
-	if st, err := os.Stat(filename); err == nil {
-		logInformationalError(output.Chmod(st.Mode()))
+		if _, ok := tok.(xml.StartElement); ok {
+			if name := duplicateAttr(raw); name != "" {
+				line, _ := decoder.InputPos()
+				return fmt.Errorf("XML syntax error on line %d: attribute %s redefined", line, name)
+			}
+		}
 
-		if os.Getuid() == 0 {
-			if ust, ok := st.Sys().(*syscall.Stat_t); ok {
-				logInformationalError(output.Chown(int(ust.Uid), int(ust.Gid)))
+		if d, ok := tok.(xml.Directive); ok {
+			for name, value := range doctypeEntities(d) {
+				if decoder.Entity == nil {
+					decoder.Entity = make(map[string]string)
+				}
+				decoder.Entity[name] = value
 			}
 		}
-	} else {
-		logInformationalError(err)
 	}
+}
+
+// duplicateAttr returns the name of the first attribute which occurs
+// twice in the raw start tag, or "" if there is none.  Names are
+// compared as written, with their prefix.
+func duplicateAttr(raw []byte) string {
+	layout, _ := parseTag(raw)
+	seen := make(map[xml.Name]bool, len(layout))
+	for _, a := range layout {
+		if seen[a.Name] {
+			return qualifiedName(a.Name)
+		}
+		seen[a.Name] = true
+	}
+	return ""
+}
 
-	logInformationalError(output.Close())
+// List writes the path of each element in the document to w, one per
+// line in the order they first occur, like /server/connector.  Each
+// path is only listed once.  If attributes is set, the attributes of
+// the elements are also listed, as /server/connector@port.  The paths
+// can be used in patterns as they are.
+func List(in io.Reader, w io.Writer, attributes bool) error {
+	return ListSeparated(in, w, attributes, '\n')
+}
 
+// ListSeparated is like List, but ends each path with sep instead of
+// a newline
+func ListSeparated(in io.Reader, w io.Writer, attributes bool, sep byte) error {
+	decoder, err := newInputDecoder(in)
 	if err != nil {
-		logInformationalError(os.Remove(tempname))
-		return fmt.Errorf("error while writing output: %v", err)
+		return err
 	}
 
-	err = os.Rename(tempname, filename)
-	if err != nil {
-		logInformationalError(os.Remove(tempname))
-		return fmt.Errorf("error while renaming temporary file to destination file: %v", err)
+	var t tracker
+	seen := make(map[string]bool)
+	print := func(path string) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		_, err := fmt.Fprintf(w, "%s%c", path, sep)
+		return err
 	}
 
-	return nil
+	for {
+		tok, err := decoder.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			t.push(tok)
+
+			var path strings.Builder
+			for _, e := range t.path {
+				path.WriteByte('/')
+				path.WriteString(escapeName(qualifiedName(e.qname)))
+			}
+			if err := print(path.String()); err != nil {
+				return err
+			}
+
+			if attributes {
+				for _, attr := range tok.Attr {
+					if err := print(path.String() + "@" + qualifiedName(attr.Name)); err != nil {
+						return err
+					}
+				}
+			}
+
+		case xml.EndElement:
+			if len(t.path) == 0 {
+				return fmt.Errorf("Unexpected end tag </%s> without start tag", qualifiedName(tok.Name))
+			}
+			t.pop()
+		}
+	}
 }
 
-// Some errors, like failing to unlink the temporary file when
-// cleaning up after a failure, can't be handled, but we should log
-// them.  This function logs if error is non-nil
-func logInformationalError(err error) {
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+// escapeName escapes the characters of an element name which have a
+// special meaning in paths, see parsePath
+func escapeName(name string) string {
+	if name == "*" || name == "comment()" {
+		return "\\" + name
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		if strings.IndexByte("/[@!~+{\\", name[i]) >= 0 {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(name[i])
 	}
+	return escaped.String()
 }
@@ -0,0 +1,638 @@
+package xmlfrob
+
+import (
+	"strings"
+	"testing"
+)
+
+// frob parses mods, lets setup adjust them, and applies them to input
+// with opts
+func frob(t *testing.T, input string, mods []string, setup func([]Modification), opts *Options) (string, error) {
+	t.Helper()
+	modifications, err := ParseModifications(mods)
+	if err != nil {
+		t.Fatalf("ParseModifications(%q): %v", mods, err)
+	}
+	if setup != nil {
+		setup(modifications)
+	}
+	var out strings.Builder
+	_, err = FrobnicateWithOptions(strings.NewReader(input), &out, modifications, opts)
+	return out.String(), err
+}
+
+// A frobTest is the expected output of applying mods to input
+type frobTest struct {
+	input string
+	mods  []string
+	want  string
+}
+
+// testFrob runs the tests with opts
+func testFrob(t *testing.T, tests []frobTest, opts *Options) {
+	t.Helper()
+	for _, test := range tests {
+		got, err := frob(t, test.input, test.mods, nil, opts)
+		if err != nil || got != test.want {
+			t.Errorf("%q on %q: got %q, %v; want %q", test.mods, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestDeclaration(t *testing.T) {
+	testFrob(t, []frobTest{
+		{`<?xml version="1.0" encoding="UTF-8"?>` + "\n<a/>", nil, `<?xml version="1.0" encoding="UTF-8"?>` + "\n<a/>"},
+		{`<?xml version="1.0" encoding="UTF-8"?>` + "\n<a x=\"1\"/>", []string{"/a@x=2"}, `<?xml version="1.0" encoding="UTF-8"?>` + "\n<a x=\"2\"/>"},
+		{`<?xml  version='1.0'   encoding='utf-8' standalone="yes" ?><a x="1"/>`, []string{"/a@x=2"}, `<?xml  version='1.0'   encoding='utf-8' standalone="yes" ?><a x="2"/>`},
+		{`<?xml version="1.0"?>` + "\r\n<a x=\"1\"/>\r\n", []string{"/a@x=2"}, `<?xml version="1.0"?>` + "\r\n<a x=\"2\"/>\r\n"},
+		{`<?xml version="1.0" encoding="ISO-8859-1"?><a x="1" y="` + "\xe6" + `"/>`, []string{"/a@x=2"}, `<?xml version="1.0" encoding="ISO-8859-1"?><a x="2" y="` + "\xe6" + `"/>`},
+		{`<a x="1"/>`, []string{"/a@x=2"}, `<a x="2"/>`},
+		{"\n<a x=\"1\"/>\n", []string{"/a@x=2"}, "\n<a x=\"2\"/>\n"},
+	}, nil)
+}
+
+func TestASCII(t *testing.T) {
+	testFrob(t, []frobTest{
+		{`<?xml version="1.0" encoding="US-ASCII"?><a x="1"/>`, []string{"/a@x=\u00e6"}, `<?xml version="1.0" encoding="US-ASCII"?><a x="&#xE6;"/>`},
+	}, nil)
+
+	input := `<?xml version="1.0" encoding="US-ASCII"?><a x="1" y="` + "\xe6" + `"/>`
+	_, err := frob(t, input, []string{"/a@x=2"}, nil, nil)
+	if want := "invalid byte 0xE6 at offset 53 for encoding US-ASCII"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestAddInt(t *testing.T) {
+	tests := []struct {
+		value, delta string
+		subtract     bool
+		width        int
+		want         string
+		err          string
+	}{
+		{"7", "1", false, 0, "8", ""},
+		{"7", "1", true, 0, "6", ""},
+		{"0", "5", true, 0, "-5", ""},
+		{"-3", "4", false, 0, "1", ""},
+		{"-3", "-4", true, 0, "1", ""},
+		{"007", "1", false, 0, "008", ""},
+		{"099", "1", false, 0, "100", ""},
+		{"010", "11", true, 0, "-001", ""},
+		{"0", "1", false, 0, "1", ""},
+		{"9", "1", false, 4, "0010", ""},
+		{"007", "1", false, 2, "08", ""},
+		{"12345", "1", false, 3, "12346", ""},
+		{"-1", "1", true, 3, "-002", ""},
+		{"9223372036854775807", "1", false, 0, "", `value "9223372036854775807" is too large to change by 1`},
+		{"-9223372036854775808", "1", true, 0, "", `value "-9223372036854775808" is too large to change by -1`},
+		{"99999999999999999999", "1", false, 0, "", `value "99999999999999999999" is not an integer`},
+		{"1.5", "1", false, 0, "", `value "1.5" is not an integer`},
+		{"", "1", false, 0, "", `value "" is not an integer`},
+		{"v2", "1", false, 0, "", `value "v2" is not an integer`},
+		{"1", "x", false, 0, "", `"x" is not an integer`},
+	}
+	for _, test := range tests {
+		got, err := addInt(test.value, test.delta, test.subtract, test.width)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("addInt(%q, %q, %v, %d) = %q, %v; want error %s", test.value, test.delta, test.subtract, test.width, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("addInt(%q, %q, %v, %d) = %q, %v; want %q", test.value, test.delta, test.subtract, test.width, got, err, test.want)
+		}
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tests := []struct {
+		input    string
+		mod      string
+		padWidth int
+		add      bool
+		want     string
+		err      string
+	}{
+		{`<a n="1"/>`, "/a@n+=1", 0, false, `<a n="2"/>`, ""},
+		{`<a n="1"/>`, "/a@n-=3", 0, false, `<a n="-2"/>`, ""},
+		{`<a n="0099"/>`, "/a@n+=1", 0, false, `<a n="0100"/>`, ""},
+		{`<a n="7"/>`, "/a@n+=1", 3, false, `<a n="008"/>`, ""},
+		{`<a/>`, "/a@n+=5", 0, true, `<a n="5"/>`, ""},
+		{`<a/>`, "/a@n+=5", 2, true, `<a n="05"/>`, ""},
+		{`<a><b n="x"/></a>`, "/a/b@n+=1", 0, false, "", `Mod "/a/b@n+=1": element /a[1]/b[1]: attribute n: value "x" is not an integer`},
+		{`<a n="9223372036854775807"/>`, "/a@n+=1", 0, false, "", `Mod "/a@n+=1": element /a[1]: attribute n: value "9223372036854775807" is too large to change by 1`},
+	}
+	for _, test := range tests {
+		got, err := frob(t, test.input, []string{test.mod}, func(mods []Modification) {
+			for i := range mods {
+				mods[i].Increment = true
+				mods[i].PadWidth = test.padWidth
+				mods[i].AddMissing = test.add
+			}
+		}, nil)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s on %s: got %q, %v; want error %s", test.mod, test.input, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s on %s: got %q, %v; want %q", test.mod, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestCheckIncrements(t *testing.T) {
+	for _, mod := range []string{"/a@n+=x", "/a@n-=1.5", "/a@n+="} {
+		mods, err := ParseModifications([]string{mod})
+		if err != nil {
+			continue // rejected when parsing already
+		}
+		mods[0].Increment = true
+		if err := CheckIncrements(mods); err == nil {
+			t.Errorf("CheckIncrements(%s) succeeded, want an error", mod)
+		}
+	}
+
+	mods, err := ParseModifications([]string{"/a@n+=x", "/a@n-=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIncrements(mods); err != nil {
+		t.Errorf("CheckIncrements without Increment: %v", err)
+	}
+}
+
+func TestQueryUnexpectedEndTag(t *testing.T) {
+	for _, query := range []string{"/a@x", "/a[text()='v']@x", "/a[b]@x"} {
+		queries, err := ParseModifications([]string{query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		_, err = Query(strings.NewReader("</a>"), queries, &out)
+		want := "Unexpected end tag </a> without start tag"
+		if err == nil || err.Error() != want {
+			t.Errorf("Query(%s) on </a>: %v, want error %s", query, err, want)
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	inputs := []string{"", " \n\t\n", "<!-- c -->", "<!-- c -->\n", "<?xml version=\"1.0\"?>\n<!-- c -->\n"}
+	for _, opts := range []*Options{nil, {Empty: EmptyExpand}, {Empty: EmptyPreserve}, {SortAttrs: true}} {
+		for _, input := range inputs {
+			got, err := frob(t, input, []string{"/a@x=1"}, nil, opts)
+			if err != nil || got != input {
+				t.Errorf("%q with %+v: got %q, %v; want it unchanged", input, opts, got, err)
+			}
+
+			got, err = frob(t, input, []string{"//comment()~=s/c/d/"}, nil, opts)
+			want := strings.Replace(input, "c -->", "d -->", 1)
+			if err != nil || got != want {
+				t.Errorf("%q with %+v: got %q, %v; want %q", input, opts, got, err, want)
+			}
+		}
+	}
+}
+
+func TestKeepReferences(t *testing.T) {
+	tests := []struct {
+		input string
+		mod   string
+		quote Quote
+		want  string
+	}{
+		{`<a x="&amp;" y="1"/>`, "/a@y=2", QuotePreserve, `<a x="&amp;" y="2"/>`},
+		{`<a x="a &amp; b &lt; &#65;" y="1"/>`, "/a@y=2", QuotePreserve, `<a x="a &amp; b &lt; &#65;" y="2"/>`},
+		{`<a x="&amp;amp;" y="1"/>`, "/a@y=2", QuotePreserve, `<a x="&amp;amp;" y="2"/>`},
+		{`<a x="&amp;"><b x="&amp;" y=""/></a>`, "/a/b@y=1", QuotePreserve, `<a x="&amp;"><b x="&amp;" y="1"/></a>`},
+		{`<a x="&amp;" y="&amp;"/>`, "/a@y+=x", QuotePreserve, `<a x="&amp;" y="&amp;x"/>`},
+		{`<a x="&amp;" y="1"/>`, "/a@y=&", QuotePreserve, `<a x="&amp;" y="&amp;"/>`},
+		{`<a x='&amp;' y='1'/>`, "/a@y=2", QuoteDouble, `<a x="&amp;" y="2"/>`},
+		{`<a x="&#38;" y="1"/>`, "/a@y=2", QuoteSingle, `<a x='&amp;' y='2'/>`},
+	}
+	for _, test := range tests {
+		got, err := frob(t, test.input, []string{test.mod}, nil, &Options{Quote: test.quote})
+		if err != nil || got != test.want {
+			t.Errorf("%s on %s: got %q, %v; want %q", test.mod, test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestStartTagWhitespace(t *testing.T) {
+	input := "<server>\n" +
+		"    <connector\n" +
+		"        port=\"8080\"\n" +
+		"        protocol = \"HTTP/1.1\"\n" +
+		"    />\n" +
+		"    <engine name=\"a\"\tdefault = 'b' >\n" +
+		"    </engine >\n" +
+		"</server>\n"
+	tests := []struct {
+		mods []string
+		want string
+	}{
+		{nil, input},
+		{[]string{"/server/other@x=1"}, input},
+		{[]string{"/server/connector@port=8181"}, strings.Replace(input, "8080", "8181", 1)},
+		{[]string{"/server/connector@protocol=AJP"}, strings.Replace(input, "HTTP/1.1", "AJP", 1)},
+		{[]string{"/server/engine@default=c"}, strings.Replace(input, "'b'", "'c'", 1)},
+		{[]string{"/server/connector@port!"}, strings.Replace(input, "\n        port=\"8080\"", "", 1)},
+	}
+	for _, test := range tests {
+		got, err := frob(t, input, test.mods, nil, nil)
+		if err != nil || got != test.want {
+			t.Errorf("%q: got\n%s, %v; want\n%s", test.mods, got, err, test.want)
+		}
+	}
+}
+
+func TestContentAroundRoot(t *testing.T) {
+	header := "<?xml version=\"1.0\"?>\n" +
+		"<!--\n  Licensed under the Apache License, Version 2.0\n-->\n" +
+		"<!-- second header -->\n" +
+		"<?xml-stylesheet href=\"a.xsl\"?>\n"
+	trailer := "\n<!-- trailer -->\n<?pi x?>\n\n\n"
+	tests := []struct {
+		root string
+		mods []string
+		want string
+	}{
+		{`<a x="1"/>`, []string{"/a@x=2"}, `<a x="2"/>`},
+		{`<a x="1"></a>`, []string{"/a@x=2"}, `<a x="2"/>`},
+		{`<a><b/></a>`, []string{"/a/b@x+=1"}, `<a><b/></a>`},
+		{`<a><b x=""/></a>`, []string{"/a/b@x+=1"}, `<a><b x="1"/></a>`},
+		{`<a/>`, []string{"/a+=<b/>"}, "<a>\n  <b/>\n</a>"},
+		{`<a><b/></a>`, []string{"/a/b!"}, `<a/>`},
+		{`<a/>`, []string{"/b@x=1", "//c@x=1"}, `<a/>`},
+	}
+	for _, test := range tests {
+		got, err := frob(t, header+test.root+trailer, test.mods, nil, nil)
+		if want := header + test.want + trailer; err != nil || got != want {
+			t.Errorf("%q on %s: got %q, %v; want %q", test.mods, test.root, got, err, want)
+		}
+	}
+
+	got, err := frob(t, header+"<a/>"+trailer, []string{"/comment()~=s/header|trailer/footer/"}, nil, nil)
+	want := strings.Replace(header, "second header", "second footer", 1) + "<a/>" + strings.Replace(trailer, "trailer", "footer", 1)
+	if err != nil || got != want {
+		t.Errorf("comments outside the root: got %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestDeletePlugins(t *testing.T) {
+	input := `<project>
+  <profiles>
+    <profile>
+      <build>
+        <plugins>
+          <plugin><artifactId>a</artifactId></plugin>
+          <plugin><artifactId>b</artifactId></plugin>
+          <plugin><artifactId>c</artifactId></plugin>
+        </plugins>
+      </build>
+    </profile>
+    <profile>
+      <build>
+        <plugins>
+          <plugin><artifactId>d</artifactId></plugin>
+        </plugins>
+      </build>
+    </profile>
+  </profiles>
+</project>
+`
+	tests := []struct {
+		mods    []string
+		deleted []string
+	}{
+		{nil, nil},
+		{[]string{"/project/profiles/profile/build/plugins/plugin[1]!", "/project/profiles/profile/build/plugins/plugin[2]!"}, []string{"a", "b", "d"}},
+		{[]string{"/project/profiles/profile[1]/build/plugins/plugin[1]!", "/project/profiles/profile[1]/build/plugins/plugin[2]!"}, []string{"a", "b"}},
+		{[]string{"/project/profiles/profile/build/plugins/plugin[3]!"}, []string{"c"}},
+		{[]string{"//plugin[2]!"}, []string{"b"}},
+		{[]string{"/project/profiles/profile/build/plugins/plugin[1]!", "/project/profiles/profile/build/plugins/plugin[1]!"}, []string{"a", "d"}},
+	}
+	for _, test := range tests {
+		want := input
+		for _, id := range test.deleted {
+			want = strings.Replace(want, "\n          <plugin><artifactId>"+id+"</artifactId></plugin>", "", 1)
+		}
+		got, err := frob(t, input, test.mods, nil, nil)
+		if err != nil || got != want {
+			t.Errorf("%q: got\n%s, %v; want\n%s", test.mods, got, err, want)
+		}
+	}
+}
+
+func TestCDATA(t *testing.T) {
+	script := "<script><![CDATA[if (a < b && c > d) { x = \"]]]]><![CDATA[>\"; }]]></script>"
+	testFrob(t, []frobTest{
+		{"<a>" + script + "</a>", nil, "<a>" + script + "</a>"},
+		{`<a x="1">` + script + "</a>", []string{"/a@x=2"}, `<a x="2">` + script + "</a>"},
+		{"<a>" + script + "</a>", []string{"/a/script@type=js"}, "<a>" + script + "</a>"},
+		{"<a><![CDATA[]]><b x=\"1\"/></a>", []string{"/a/b@x=2"}, "<a><![CDATA[]]><b x=\"2\"/></a>"},
+		{"<a>x &lt; y<![CDATA[<&>]]>z</a>", []string{"/a+=<b/>"}, "<a>x &lt; y<![CDATA[<&>]]>z<b/></a>"},
+	}, nil)
+}
+
+func TestDoctype(t *testing.T) {
+	doctype := "<!DOCTYPE server [\n  <!ENTITY port \"8080\">\n  <!ENTITY  name 'x &amp; y'>\n]>\n"
+	testFrob(t, []frobTest{
+		{doctype + `<server port="&port;"/>`, nil, doctype + `<server port="&port;"/>`},
+		{doctype + `<server port="&port;" n="&name;"/>`, []string{"/server@port=8181"}, doctype + `<server port="8181" n="&name;"/>`},
+		{doctype + `<server port="&port;">&name;</server>`, []string{"/server@x=1"}, doctype + `<server port="&port;">&name;</server>`},
+		{`<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">` + "\n<html a=\"1\"/>", []string{"/html@a=2"}, `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">` + "\n<html a=\"2\"/>"},
+	}, nil)
+
+	if _, err := frob(t, doctype+`<server port="&undeclared;"/>`, []string{"/server@x=1"}, nil, nil); err == nil {
+		t.Errorf("undeclared entity accepted")
+	}
+}
+
+func TestAttributeOrder(t *testing.T) {
+	testFrob(t, []frobTest{
+		{`<a z="1" b="2"   m="3"	a="4"/>`, nil, `<a z="1" b="2"   m="3"	a="4"/>`},
+		{`<a z="1" b="2"   m="3"	a="4"/>`, []string{"/a@m=x"}, `<a z="1" b="2"   m="x"	a="4"/>`},
+		{`<a z="1" b="2"   m="3"	a="4"/>`, []string{"/a@z!"}, `<a b="2"   m="3"	a="4"/>`},
+		{`<a z="1" b="2"   m="3"	a="4"/>`, []string{"/a@b~c"}, `<a z="1" c="2"   m="3"	a="4"/>`},
+		{`<a xmlns:p="u" p:z="1" b='2'/>`, []string{"/a@b=x"}, `<a xmlns:p="u" p:z="1" b='x'/>`},
+		{"<a\n  z=\"1\"\n  b=\"2\"/>", []string{"/a@z=x", "/a@b=y"}, "<a\n  z=\"x\"\n  b=\"y\"/>"},
+	}, nil)
+}
+
+func TestEntityReferences(t *testing.T) {
+	text := "a &amp; b &lt;c&gt; &#65;&#x42; &quot;&apos;"
+	testFrob(t, []frobTest{
+		{"<a>" + text + "</a>", nil, "<a>" + text + "</a>"},
+		{`<a x="1">` + text + "</a>", []string{"/a@x=2"}, `<a x="2">` + text + "</a>"},
+		{`<a x="` + text + `"/>`, []string{"/a@y=2"}, `<a x="` + text + `"/>`},
+		{`<a x="` + text + `" y="1"/>`, []string{"/a@y=2"}, `<a x="` + text + `" y="2"/>`},
+		{`<a x="&#65;"/>`, []string{"/a@x+=&"}, `<a x="A&amp;"/>`},
+		{`<a x="1"/>`, []string{`/a@x="<&>"`}, `<a x="&quot;&lt;&amp;&gt;&quot;"/>`},
+		{`<a><b x="&amp;">` + text + "</b></a>", []string{"/a/b~c"}, `<a><c x="&amp;">` + text + "</c></a>"},
+	}, nil)
+}
+
+func TestBOM(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	tests := []frobTest{
+		{bom + `<a x="1"/>`, nil, bom + `<a x="1"/>`},
+		{bom + `<a x="1"/>`, []string{"/a@x=2"}, bom + `<a x="2"/>`},
+		{bom + `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<a x="1"/>`, []string{"/a@x=2"}, bom + `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<a x="2"/>`},
+		{`<a x="1"/>`, []string{"/a@x=2"}, `<a x="2"/>`},
+	}
+	testFrob(t, tests, nil)
+
+	for i := range tests {
+		tests[i].want = strings.TrimPrefix(tests[i].want, bom)
+	}
+	testFrob(t, tests, &Options{StripBOM: true})
+}
+
+func TestMinify(t *testing.T) {
+	testFrob(t, []frobTest{
+		{"<a>\n  <b x=\"1\"/>\n  <c>text</c>\n</a>\n", nil, `<a><b x="1"/><c>text</c></a>`},
+		{"<a>\n  <b x=\"1\"/>\n  <c> two  words </c>\n</a>\n", []string{"/a/b@x=2"}, `<a><b x="2"/><c> two  words </c></a>`},
+		{"<a>\n  <p>mixed <b>bold</b> text</p>\n</a>", nil, "<a><p>mixed <b>bold</b> text</p></a>"},
+		{"<a>\n  <pre xml:space=\"preserve\">\n    <b/>\n  </pre>\n</a>", nil, "<a><pre xml:space=\"preserve\">\n    <b/>\n  </pre></a>"},
+		{"<a>\n  <!-- c -->\n  <b/>\n</a>", nil, "<a><!-- c --><b/></a>"},
+	}, &Options{Minify: true})
+}
+
+func TestProcessingInstructions(t *testing.T) {
+	stylesheet := `<?xml-stylesheet  type="text/xsl"   href='style.xsl' ?>`
+	testFrob(t, []frobTest{
+		{stylesheet + "\n<a/>", nil, stylesheet + "\n<a/>"},
+		{`<?xml version="1.0"?>` + "\n" + stylesheet + "\n<a x=\"1\"/>", []string{"/a@x=2"}, `<?xml version="1.0"?>` + "\n" + stylesheet + "\n<a x=\"2\"/>"},
+		{"<a x=\"1\"><?php echo \"<a>\"; ?><?target?></a>", []string{"/a@x=2"}, "<a x=\"2\"><?php echo \"<a>\"; ?><?target?></a>"},
+		{"<a><b x=\"1\"><?pi data?></b></a>", []string{"/a/b@x=2"}, "<a><b x=\"2\"><?pi data?></b></a>"},
+		{"<a/>" + stylesheet, []string{"/a@x=2"}, "<a/>" + stylesheet},
+	}, nil)
+}
+
+func TestSelfClosing(t *testing.T) {
+	tests := []struct {
+		input    string
+		collapse string
+		expand   string
+		preserve string
+	}{
+		{`<a x="1"/>`, `<a x="2"/>`, `<a x="2"></a>`, `<a x="2"/>`},
+		{`<a x="1" />`, `<a x="2" />`, `<a x="2"></a>`, `<a x="2" />`},
+		{`<a x="1"></a>`, `<a x="2"/>`, `<a x="2"></a>`, `<a x="2"></a>`},
+		{`<a x="1"><?pi?></a>`, `<a x="2"><?pi?></a>`, `<a x="2"><?pi?></a>`, `<a x="2"><?pi?></a>`},
+		{`<a x="1"><!-- c --></a>`, `<a x="2"><!-- c --></a>`, `<a x="2"><!-- c --></a>`, `<a x="2"><!-- c --></a>`},
+		{`<a x="1"><![CDATA[]]></a>`, `<a x="2"><![CDATA[]]></a>`, `<a x="2"><![CDATA[]]></a>`, `<a x="2"><![CDATA[]]></a>`},
+		{`<r><a x="1"/><?pi?></r>`, `<r><a x="2"/><?pi?></r>`, `<r><a x="2"></a><?pi?></r>`, `<r><a x="2"/><?pi?></r>`},
+		{`<r><?pi?><a x="1"></a></r>`, `<r><?pi?><a x="2"/></r>`, `<r><?pi?><a x="2"></a></r>`, `<r><?pi?><a x="2"></a></r>`},
+	}
+	for _, test := range tests {
+		mods := []string{"//a@x=2"}
+		testFrob(t, []frobTest{{test.input, mods, test.collapse}}, &Options{Empty: EmptyCollapse})
+		testFrob(t, []frobTest{{test.input, mods, test.expand}}, &Options{Empty: EmptyExpand})
+		testFrob(t, []frobTest{{test.input, mods, test.preserve}}, &Options{Empty: EmptyPreserve})
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	input := "<?xml version=\"1.0\"?>\n<!-- header -->\n<server port=\"8005\">\n" +
+		"  <connector port=\"8080\" protocol='HTTP/1.1'/>\n" +
+		"  <connector\n      port=\"8009\"\n      protocol=\"AJP/1.3\" />\n" +
+		"  <engine name=\"a &amp; b\"><![CDATA[x < y]]></engine>\n" +
+		"  <old/>\n" +
+		"</server>\n"
+	mods := [][]string{
+		{"/server/connector@port=8181"},
+		{"//connector[@protocol='AJP/1.3']@port!"},
+		{"/server/connector@protocol~proto"},
+		{"/server/old!", "/server/engine~host"},
+		{"/server/connector@secure=true", "/server@port=-1"},
+		{"/server/engine@name~=s/a/c/"},
+		{"//comment()~=s/header/footer/"},
+	}
+	for _, opts := range []*Options{nil, {Quote: QuoteSingle}, {Indent: "    "}, {Minify: true}, {SortAttrs: true}, {Empty: EmptyExpand}} {
+		for _, m := range mods {
+			once, err := frob(t, input, m, nil, opts)
+			if err != nil {
+				t.Fatalf("%q with %+v: %v", m, opts, err)
+			}
+			twice, err := frob(t, once, m, nil, opts)
+			if err != nil || twice != once {
+				t.Errorf("%q with %+v: second run gave %q, %v; want %q", m, opts, twice, err, once)
+			}
+		}
+	}
+}
+
+func TestAdjacentComments(t *testing.T) {
+	testFrob(t, []frobTest{
+		{"<a><!-- before --><b x=\"1\"/><!-- after --></a>", []string{"/a/b@x=2"}, "<a><!-- before --><b x=\"2\"/><!-- after --></a>"},
+		{"<a>\n  <!-- before -->\n  <b x=\"1\"/>  <!-- after -->\n</a>", []string{"/a/b@x=2"}, "<a>\n  <!-- before -->\n  <b x=\"2\"/>  <!-- after -->\n</a>"},
+		{"<a><!-- before --><b x=\"1\"></b><!-- after --></a>", []string{"/a/b@x=2"}, "<a><!-- before --><b x=\"2\"/><!-- after --></a>"},
+		{"<a><b x=\"1\"><!-- inside --></b></a>", []string{"/a/b@x=2"}, "<a><b x=\"2\"><!-- inside --></b></a>"},
+		{"<a><!--before--><b/><!--after--></a>", []string{"/a/b+=<c/>"}, "<a><!--before--><b><c/></b><!--after--></a>"},
+		{"<a><!-- before --><b x=\"1\"/><!-- after --></a>", []string{"/a/b~c"}, "<a><!-- before --><c x=\"1\"/><!-- after --></a>"},
+		{"<a>\n  <!-- before -->\n  <b/>\n  <!-- after -->\n</a>", []string{"/a/b@x=1"}, "<a>\n  <!-- before -->\n  <b/>\n  <!-- after -->\n</a>"},
+	}, nil)
+}
+
+func TestAttributeNewlines(t *testing.T) {
+	testFrob(t, []frobTest{
+		{"<a x=\"one\n  two\" y=\"1\"/>", []string{"/a@y=2"}, "<a x=\"one\n  two\" y=\"2\"/>"},
+		{"<a x=\"one\n  two\"/>", []string{"/a@x+=\nthree"}, "<a x=\"one\n  two\nthree\"/>"},
+		{"<a x=\"one\r\ntwo\"/>", []string{"/a@x+=!"}, "<a x=\"one\r\ntwo!\"/>"},
+		{"<a x=\"one&#10;two&#9;three\"/>", []string{"/a@x+=!"}, "<a x=\"one&#xA;two&#x9;three!\"/>"},
+		{"<a x=\"one\ttwo\"/>", []string{"/a@x~=s/one/1/"}, "<a x=\"1\ttwo\"/>"},
+		{"<a x=\"one\n  two\"/>", []string{"/a@x~y"}, "<a y=\"one\n  two\"/>"},
+	}, nil)
+}
+
+func TestRenameAttribute(t *testing.T) {
+	testFrob(t, []frobTest{
+		{`<r><a x="1" z="2"/></r>`, []string{"/r/a@x~y"}, `<r><a y="1" z="2"/></r>`},
+		{`<r><a x="1"/></r>`, []string{"/r/a@x~x"}, `<r><a x="1"/></r>`},
+		{`<r><a p:x="1" y="2"/></r>`, []string{"/r/a@p:x~y"}, `<r><a p:y="1" y="2"/></r>`},
+		{`<r><a z="1"/></r>`, []string{"/r/a@x~y"}, `<r><a z="1"/></r>`},
+	}, nil)
+
+	tests := []struct {
+		input string
+		mods  []string
+		add   bool
+	}{
+		{`<r><a x="1" y="2"/></r>`, []string{"/r/a@x~y"}, false},
+		{`<r><a x="1"/></r>`, []string{"/r/a@y=2", "/r/a@x~y"}, true},
+	}
+	for _, test := range tests {
+		_, err := frob(t, test.input, test.mods, func(mods []Modification) {
+			for i := range mods {
+				mods[i].AddMissing = test.add
+			}
+		}, nil)
+		if want := "cannot rename attribute x to y, which already exists"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q on %s: got %v, want %q", test.mods, test.input, err, want)
+		}
+	}
+
+	for _, mod := range []string{"/r/a@x~s/a/b/", "/r/a@x~1y", "/r/a@x~y z"} {
+		if _, err := parseModification(mod); err == nil {
+			t.Errorf("%s: no error", mod)
+		}
+	}
+}
+
+func TestPrefixedAttributes(t *testing.T) {
+	const input = `<r><f xsi:type="a" xlink:href="h" type="c"/></r>`
+	tests := []struct {
+		input string
+		mods  []string
+		add   bool
+		want  string
+	}{
+		{input, []string{"/r/f@type!"}, false, `<r><f xsi:type="a" xlink:href="h"/></r>`},
+		{input, []string{"/r/f@xsi:type!"}, false, `<r><f xlink:href="h" type="c"/></r>`},
+		{input, []string{"/r/f@type=z"}, false, `<r><f xsi:type="a" xlink:href="h" type="z"/></r>`},
+		{input, []string{"/r/f@xsi:type=z"}, false, `<r><f xsi:type="z" xlink:href="h" type="c"/></r>`},
+		{input, []string{"/r/f@href=x"}, false, input},
+		{input, []string{"/r/f@xlink:href=x"}, false, `<r><f xsi:type="a" xlink:href="x" type="c"/></r>`},
+		{input, []string{"/r/f[@type='a']@type=z"}, false, input},
+		{input, []string{"/r/f[@xsi:type='a']@type=z"}, false, `<r><f xsi:type="a" xlink:href="h" type="z"/></r>`},
+		{`<r><f xsi:type="a"/></r>`, []string{"/r/f@type=b"}, true, `<r><f xsi:type="a" type="b"/></r>`},
+		{`<r><f type="a"/></r>`, []string{"/r/f@xsi:type=b"}, true, `<r><f type="a" xsi:type="b"/></r>`},
+	}
+	for _, test := range tests {
+		got, err := frob(t, test.input, test.mods, func(mods []Modification) {
+			mods[0].AddMissing = test.add
+		}, nil)
+		if err != nil || got != test.want {
+			t.Errorf("%q on %s: got %q, %v; want %q", test.mods, test.input, got, err, test.want)
+		}
+	}
+
+	for query, want := range map[string]string{"/r/f@type": "c\n", "/r/f@xsi:type": "a\n", "/r/f@href": ""} {
+		queries, err := ParseModifications([]string{query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		if _, err := QuerySeparated(strings.NewReader(input), queries, &out, '\n'); err != nil || out.String() != want {
+			t.Errorf("%s: got %q, %v; want %q", query, out.String(), err, want)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	testFrob(t, []frobTest{
+		{`<a x="8080"/>`, []string{"/a@x[==8080]=8181"}, `<a x="8181"/>`},
+		{`<a x="8181"/>`, []string{"/a@x[==8080]=8181"}, `<a x="8181"/>`},
+		{`<a x=""/>`, []string{"/a@x[==]=1"}, `<a x="1"/>`},
+		{`<a x="0"/>`, []string{"/a@x[==]=1"}, `<a x="0"/>`},
+		{`<a x=""/>`, []string{"/a@x[==]!"}, `<a/>`},
+		{`<a/>`, []string{"/a@x[==]=1"}, `<a/>`},
+	}, nil)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`<a x="1" y="2"><b y="1"/></a>`, ""},
+		{`<a p:y="1" y="2" q:y="3" xmlns:p="u" xmlns:q="v"/>`, ""},
+		{`<a y="1" y="2"/>`, "XML syntax error on line 1: attribute y redefined"},
+		{"<a>\n<b\n  p:y='1'\n  p:y='2'></b></a>", "XML syntax error on line 4: attribute p:y redefined"},
+		{`<a><b></a>`, "element <b> closed by </a>"},
+	}
+	for _, test := range tests {
+		err := Validate(strings.NewReader(test.input))
+		if (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want %q", test.input, err, test.err)
+		}
+	}
+}
+
+func TestBindAttributeNamespaces(t *testing.T) {
+	const input = `<r xmlns:xsi="u"><f xsi:type="a" type="c"/></r>`
+	tests := []struct {
+		input string
+		mods  []string
+		add   bool
+		want  string
+	}{
+		{input, []string{"/r/f@x:type=z"}, false, `<r xmlns:xsi="u"><f xsi:type="z" type="c"/></r>`},
+		{input, []string{"/r/f@x:type!"}, false, `<r xmlns:xsi="u"><f type="c"/></r>`},
+		{input, []string{"/r/f@xsi:type=z"}, false, `<r xmlns:xsi="u"><f xsi:type="z" type="c"/></r>`},
+		{input, []string{"/r/f[@x:type='a']@type=z"}, false, `<r xmlns:xsi="u"><f xsi:type="a" type="z"/></r>`},
+		{input, []string{"/r/f[@x:type='c']@type=z"}, false, input},
+		{`<r xmlns:x="v" xmlns:xsi="u"><f x:type="1" xsi:type="2"/></r>`, []string{"/r/f@x:type=z"}, false, `<r xmlns:x="v" xmlns:xsi="u"><f x:type="1" xsi:type="z"/></r>`},
+		{`<r xmlns:xsi="u"><f/></r>`, []string{"/r/f@x:type=z"}, true, `<r xmlns:xsi="u"><f xsi:type="z"/></r>`},
+		{`<r><f/></r>`, []string{"/r/f@x:type=z"}, true, `<r><f x:type="z"/></r>`},
+		{`<r xmlns:xsi="u"><f xsi:type="a"/></r>`, []string{"/r/f@x:type=z"}, true, `<r xmlns:xsi="u"><f xsi:type="z"/></r>`},
+	}
+	bind := func(mods []Modification) {
+		BindNamespaces(mods, map[string]string{"x": "u"})
+	}
+	for _, test := range tests {
+		got, err := frob(t, test.input, test.mods, func(mods []Modification) {
+			bind(mods)
+			mods[0].AddMissing = test.add
+		}, nil)
+		if err != nil || got != test.want {
+			t.Errorf("%q on %s: got %q, %v; want %q", test.mods, test.input, got, err, test.want)
+		}
+	}
+
+	queries, err := ParseModifications([]string{"/r/f@x:type"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind(queries)
+	var out strings.Builder
+	if _, err := QuerySeparated(strings.NewReader(input), queries, &out, '\n'); err != nil || out.String() != "a\n" {
+		t.Errorf("query: got %q, %v; want %q", out.String(), err, "a\n")
+	}
+}